@@ -89,44 +89,8 @@ func checkACL(acl s3.GetObjectAclOutput,
 	}
 
 	if !found {
-		fmt.Println("Wrong ACL!", acl, bucket, obj)
-
-		return true
-	}
-
-	return false
-}
-
-// checkACL returns true if the ACL is ok, false otherwise.
-func checkThreeACL(
-	acl s3.GetObjectAclOutput,
-	bucket string,
-	obj string,
-	desiredOwnerAcct string,
-) bool {
-	fmt.Println("Checking ACL for", bucket, obj, desiredOwnerAcct)
-
-	canonID, ok := getCanonIDMaybeCall(desiredOwnerAcct)
-	if !ok {
-		return true // fail open
-	}
-
-	if (acl.Owner.ID != nil) && (*acl.Owner.ID == canonID) {
-		fmt.Println("bad owner for", bucket, obj, desiredOwnerAcct)
-
-		return false
-	}
-
-	found := false
-
-	for _, g := range acl.Grants {
-		if (g.Grantee.ID != nil) && (*g.Grantee.ID == canonID) {
-			found = true
-		}
-	}
-
-	if !found {
-		fmt.Println("Wrong ACL!", acl, bucket, obj)
+		owner, grants := aclShapeOf(acl)
+		fmt.Println("Wrong ACL!", bucket, obj, "owner", owner, "grants", grants)
 
 		return true
 	}
@@ -194,7 +158,8 @@ func handleACL( //nolint:cyclop
 
 	doIt := checkACL(*getACL, bucket, obj, bucketAcct)
 	if doIt {
-		fmt.Println("ERROR: Got result", doIt, bucketAcct, bucket, obj, *getACL)
+		owner, grants := aclShapeOf(*getACL)
+		fmt.Println("ERROR: Got result", doIt, bucketAcct, bucket, obj, "owner", owner, "grants", grants)
 		count.Incr("bad-acl-found")
 	}
 
@@ -237,28 +202,24 @@ func handleACL( //nolint:cyclop
 	}
 }
 
-// fixAndVerifyThreeACL applies the ACL fix for a single account and re-fetches to verify.
-// Returns false if PutObjectAcl fails (caller should stop processing).
+// fixAndVerifyThreeACL puts the ACL with the missing grants added and
+// the ones to remove taken off, then re-fetches to verify.  Returns the
+// action for the report.
 func fixAndVerifyThreeACL(
 	svc *s3.S3,
 	getACL *s3.GetObjectAclOutput,
 	bucket string,
 	obj string,
-	readAcct string,
-) (*s3.GetObjectAclOutput, bool) {
-	newACL, err := fixACL(*getACL, bucket, obj, readAcct)
+	missing []aclWant,
+	remove []aclWant,
+) string {
+	newACL := applyACLDiff(*getACL, missing, remove)
 
 	fmt.Println("NewACL/OldACL", *getACL, newACL)
 
-	if err != nil {
-		logCountErr(err, "Get new ACL failed"+bucket+"/"+obj)
-
-		return getACL, true // continue to next account
-	}
-
 	count.Incr("aws-put-object-3acl")
 
-	_, err = svc.PutObjectAcl(&s3.PutObjectAclInput{
+	_, err := svc.PutObjectAcl(&s3.PutObjectAclInput{
 		AccessControlPolicy: &newACL,
 		Bucket:              aws.String(bucket),
 		Key:                 aws.String(obj),
@@ -266,27 +227,36 @@ func fixAndVerifyThreeACL(
 	if err != nil {
 		logCountErr(err, "PutObjectAcl failed"+bucket+"/"+obj)
 
-		return getACL, false // stop processing
+		return "fix-failed"
 	}
 
-	fmt.Println("Successfully fixed", readAcct, bucket, obj)
+	fmt.Println("Successfully fixed", bucket, obj)
 
 	refreshed, err := svc.GetObjectAcl(&s3.GetObjectAclInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(obj),
 	})
-	if refreshed != nil {
-		fmt.Println("refetched acl", obj, *refreshed)
+	if refreshed == nil {
+		fmt.Println("refetched acl err", err)
 
-		return refreshed, true
+		return "fixed-unverified"
 	}
 
-	fmt.Println("refetched acl err", err)
+	fmt.Println("refetched acl", obj, *refreshed)
 
-	return getACL, true
+	if m, f, e := diffACL(*refreshed, rulesFor(theCtx.desiredACL, bucket, obj)); len(m)+len(f)+len(e) > 0 {
+		count.Incr("bad-3acl-after-fix")
+
+		return "fix-not-verified"
+	}
+
+	return "fixed"
 }
 
-// handleThreeAcl does all the logic for Acl get/set
+// handleThreeAcl checks the object ACL against the desired ACL rules
+// (desiredAclFile, or each threeAcctAclReader account with
+// FULL_CONTROL) and in danger mode puts the smallest change that
+// fixes it, removing grants as well as adding them.
 // no error - it will print out any errors.
 func handleThreeACL(
 	bucket string,
@@ -294,6 +264,13 @@ func handleThreeACL(
 	_ string,
 	sess *session.Session,
 ) {
+	rules := rulesFor(theCtx.desiredACL, bucket, obj)
+	if len(rules) == 0 {
+		count.Incr("desired-acl-no-rules")
+
+		return
+	}
+
 	svc := s3.New(sess)
 
 	count.Incr("aws-get-object-3acl")
@@ -308,25 +285,38 @@ func handleThreeACL(
 		return
 	}
 
-	shouldFix := theConfig["readOnly"].StrVal == danger && theConfig["setToDangerToForceACL"].StrVal == danger
+	missing, forbidden, extra := diffACL(*getACL, rules)
+	if len(missing)+len(forbidden)+len(extra) == 0 {
+		count.Incr("good-3acl-found")
 
-	for _, readAcct := range strings.Split(theConfig["threeAcctAclReader"].StrVal, ",") {
-		if !checkThreeACL(*getACL, bucket, obj, readAcct) {
-			continue
-		}
+		return
+	}
 
-		fmt.Println("ERROR: Got result", true, bucket, obj, *getACL)
-		count.Incr("bad-3acl-found")
+	owner, grants := aclShapeOf(*getACL)
+	fmt.Println("ERROR: Got result", true, bucket, obj, "owner", owner, "grants", grants)
+	count.Incr("bad-3acl-found")
 
-		if !shouldFix {
-			continue
-		}
+	action := "dry-run"
 
-		var ok bool
+	if theConfig["readOnly"].StrVal == danger && theConfig["setToDangerToForceACL"].StrVal == danger {
+		action = fixAndVerifyThreeACL(svc, getACL, bucket, obj, missing, append(forbidden, extra...))
+	}
 
-		getACL, ok = fixAndVerifyThreeACL(svc, getACL, bucket, obj, readAcct)
-		if !ok {
-			return
-		}
+	for _, w := range missing {
+		count.Incr("desired-acl-missing")
+		writeReportRow(theConfig["desiredAclReport"].StrVal, aclDiffHeader,
+			[]string{bucket, obj, w.label, w.perm, "missing", action})
+	}
+
+	for _, w := range forbidden {
+		count.Incr("desired-acl-forbidden")
+		writeReportRow(theConfig["desiredAclReport"].StrVal, aclDiffHeader,
+			[]string{bucket, obj, w.label, w.perm, "forbidden", action})
+	}
+
+	for _, w := range extra {
+		count.Incr("desired-acl-extra")
+		writeReportRow(theConfig["desiredAclReport"].StrVal, aclDiffHeader,
+			[]string{bucket, obj, w.label, w.perm, "not-in-spec", action})
 	}
 }
@@ -0,0 +1,164 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+// aclInventoryHeader is the header row of the per object ACL report.
+var aclInventoryHeader = []string{"bucket", "key", "owner", "grants"}
+
+// aclShapesHeader is the header row of the ACL shapes report.
+var aclShapesHeader = []string{"bucket", "shape", "objects", "owner", "grants", "sample_keys"}
+
+// aclShape is one distinct owner and grant set seen in a bucket.
+type aclShape struct {
+	owner   string
+	grants  string
+	objects int64
+	samples []string
+}
+
+// principalLabel names a canonical ID by its account (and org
+// account name) when we know it.
+func principalLabel(canonID string) string {
+	a := acctForCanonID(canonID)
+	if a == "" {
+		return canonID
+	}
+
+	if name := theCtx.orgAccts[a]; name != "" {
+		return a + "(" + name + ")"
+	}
+
+	return a
+}
+
+// aclShapeOf returns the owner and the sorted grants of an ACL with
+// canonical IDs turned into accounts where we can.
+func aclShapeOf(acl s3.GetObjectAclOutput) (string, string) {
+	owner := ""
+	if acl.Owner != nil {
+		owner = principalLabel(aws.StringValue(acl.Owner.ID))
+	}
+
+	grants := make([]string, 0, len(acl.Grants))
+
+	for _, g := range acl.Grants {
+		label := "?"
+
+		if g.Grantee != nil {
+			switch {
+			case g.Grantee.URI != nil:
+				label = groupName(aws.StringValue(g.Grantee.URI))
+			case g.Grantee.ID != nil:
+				label = principalLabel(aws.StringValue(g.Grantee.ID))
+			default:
+				label = aws.StringValue(g.Grantee.EmailAddress)
+			}
+		}
+
+		grants = append(grants, label+":"+aws.StringValue(g.Permission))
+	}
+
+	sort.Strings(grants)
+
+	return owner, strings.Join(grants, " ")
+}
+
+// addACLShape counts the object under its bucket's shape, keeping
+// the first few keys as samples.
+func addACLShape(bucket string, key string, owner string, grants string) {
+	theCtx.aclShapesRW.Lock()
+	defer theCtx.aclShapesRW.Unlock()
+
+	shapes, ok := theCtx.aclShapes[bucket]
+	if !ok {
+		shapes = make(map[string]*aclShape)
+		theCtx.aclShapes[bucket] = shapes
+	}
+
+	id := owner + "|" + grants
+
+	s, ok := shapes[id]
+	if !ok {
+		s = &aclShape{owner: owner, grants: grants}
+		shapes[id] = s
+
+		count.Incr("acl-shape-new")
+	}
+
+	s.objects++
+
+	if len(s.samples) < theConfig["aclShapeSamples"].IntVal {
+		s.samples = append(s.samples, key)
+	}
+}
+
+// inventoryACL records one object's owner and grants.
+func inventoryACL(bucket string, key string, sess *session.Session) {
+	svc := s3.New(sess)
+
+	count.Incr("aws-get-object-acl-inventory")
+
+	acl, err := svc.GetObjectAcl(&s3.GetObjectAclInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil || acl == nil {
+		logCountErrTag(err, "GetObjectAcl failed "+bucket+"/"+key, bucket)
+
+		return
+	}
+
+	owner, grants := aclShapeOf(*acl)
+
+	addACLShape(bucket, key, owner, grants)
+
+	if theConfig["aclInventoryPerObject"].BoolVal {
+		writeReportRow(theConfig["aclInventoryReport"].StrVal, aclInventoryHeader,
+			[]string{bucket, key, owner, grants})
+	}
+}
+
+// writeACLShapes writes the shapes report, most common shape first
+// in each bucket.  Called at exit.
+func writeACLShapes() {
+	theCtx.aclShapesRW.Lock()
+	defer theCtx.aclShapesRW.Unlock()
+
+	buckets := make([]string, 0, len(theCtx.aclShapes))
+	for b := range theCtx.aclShapes {
+		buckets = append(buckets, b)
+	}
+
+	sort.Strings(buckets)
+
+	for _, b := range buckets {
+		shapes := make([]*aclShape, 0, len(theCtx.aclShapes[b]))
+		for _, s := range theCtx.aclShapes[b] {
+			shapes = append(shapes, s)
+		}
+
+		sort.Slice(shapes, func(i, j int) bool { return shapes[i].objects > shapes[j].objects })
+
+		log.Println("ACL shapes for", b, len(shapes))
+		fmt.Println("Bucket", b, "has", len(shapes), "distinct ACL shapes")
+
+		for i, s := range shapes {
+			writeReportRow(theConfig["aclShapesReport"].StrVal, aclShapesHeader, []string{
+				b, strconv.Itoa(i + 1), strconv.FormatInt(s.objects, 10),
+				s.owner, s.grants, strings.Join(s.samples, " "),
+			})
+		}
+
+		count.IncrDelta("acl-shapes", int64(len(shapes)))
+	}
+}
@@ -0,0 +1,318 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3control"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	groupAllUsers          = "http://acs.amazonaws.com/groups/global/AllUsers"
+	groupAuthUsers         = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+	groupLogDelivery       = "http://acs.amazonaws.com/groups/s3/LogDelivery"
+	errCodeNoOwnership     = "OwnershipControlsNotFoundError"
+	errCodeNoPublicBlock   = "NoSuchPublicAccessBlockConfiguration"
+	ownershipNotConfigured = "none"
+)
+
+// bucketAccessHeader is the header row of the bucket access report.
+var bucketAccessHeader = []string{
+	"account", "bucket", "region", "object_ownership", "acls_enabled",
+	"bucket_block_public_acls", "bucket_ignore_public_acls",
+	"bucket_block_public_policy", "bucket_restrict_public_buckets",
+	"account_block_public_acls", "account_ignore_public_acls",
+	"account_block_public_policy", "account_restrict_public_buckets",
+	"public_grants", "other_account_grants", "policy_is_public",
+	"is_public", "error",
+}
+
+// publicBlock is one Public Access Block config.  found is false
+// when there is none, which is the same as all false.
+type publicBlock struct {
+	found                 bool
+	blockPublicAcls       bool
+	ignorePublicAcls      bool
+	blockPublicPolicy     bool
+	restrictPublicBuckets bool
+}
+
+// cols formats the four flags for the report.
+func (p publicBlock) cols() []string {
+	return []string{
+		strconv.FormatBool(p.blockPublicAcls), strconv.FormatBool(p.ignorePublicAcls),
+		strconv.FormatBool(p.blockPublicPolicy), strconv.FormatBool(p.restrictPublicBuckets),
+	}
+}
+
+// newPublicBlock makes a found publicBlock from either API's flags.
+func newPublicBlock(bpa *bool, ipa *bool, bpp *bool, rpb *bool) publicBlock {
+	return publicBlock{
+		found:                 true,
+		blockPublicAcls:       aws.BoolValue(bpa),
+		ignorePublicAcls:      aws.BoolValue(ipa),
+		blockPublicPolicy:     aws.BoolValue(bpp),
+		restrictPublicBuckets: aws.BoolValue(rpb),
+	}
+}
+
+// bucketAccess is who can get at one bucket.
+type bucketAccess struct {
+	acctID         string
+	bucket         string
+	region         string
+	ownership      string
+	bucketBlock    publicBlock
+	acctBlock      publicBlock
+	publicGrants   []string
+	otherGrants    []string
+	policyIsPublic bool
+	errs           []string
+}
+
+// aclsEnabled is true unless ownership is BucketOwnerEnforced.
+func (a bucketAccess) aclsEnabled() bool {
+	return a.ownership != s3.ObjectOwnershipBucketOwnerEnforced
+}
+
+// isPublic says if a public grant or policy gets past the blocks.
+func (a bucketAccess) isPublic() bool {
+	aclPublic := len(a.publicGrants) > 0 && a.aclsEnabled() &&
+		!a.bucketBlock.ignorePublicAcls && !a.acctBlock.ignorePublicAcls
+	policyPublic := a.policyIsPublic &&
+		!a.bucketBlock.restrictPublicBuckets && !a.acctBlock.restrictPublicBuckets
+
+	return aclPublic || policyPublic
+}
+
+// row formats the access posture for the report.
+func (a bucketAccess) row() []string {
+	r := []string{a.acctID, a.bucket, a.region, a.ownership, strconv.FormatBool(a.aclsEnabled())}
+	r = append(r, a.bucketBlock.cols()...)
+	r = append(r, a.acctBlock.cols()...)
+
+	return append(r,
+		strings.Join(a.publicGrants, " "), strings.Join(a.otherGrants, " "),
+		strconv.FormatBool(a.policyIsPublic), strconv.FormatBool(a.isPublic()),
+		strings.Join(a.errs, "; "))
+}
+
+// isErrCode is true if err is an AWS error with that code.
+func isErrCode(err error, code string) bool {
+	var aerr awserr.Error
+
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
+
+// getAcctPublicBlock reads the account level Public Access Block,
+// once per account.
+func getAcctPublicBlock(acctID string, sess *session.Session) (publicBlock, error) {
+	theCtx.acctBlockRW.RLock()
+	pb, ok := theCtx.acctBlocks[acctID]
+	theCtx.acctBlockRW.RUnlock()
+
+	if ok {
+		return pb, nil
+	}
+
+	count.Incr("aws-get-acct-public-access-block")
+
+	out, err := s3control.New(sess).GetPublicAccessBlock(&s3control.GetPublicAccessBlockInput{
+		AccountId: aws.String(acctID),
+	})
+
+	switch {
+	case err != nil && isErrCode(err, errCodeNoPublicBlock):
+		count.Incr("acct-public-access-block-none")
+	case err != nil:
+		logCountErr(err, "GetPublicAccessBlock failed for account "+acctID)
+
+		return pb, err
+	case out.PublicAccessBlockConfiguration != nil:
+		c := out.PublicAccessBlockConfiguration
+		pb = newPublicBlock(c.BlockPublicAcls, c.IgnorePublicAcls, c.BlockPublicPolicy, c.RestrictPublicBuckets)
+	}
+
+	theCtx.acctBlockRW.Lock()
+	theCtx.acctBlocks[acctID] = pb
+	theCtx.acctBlockRW.Unlock()
+
+	return pb, nil
+}
+
+// getBucketPublicBlock reads the bucket level Public Access Block.
+func getBucketPublicBlock(bucket string, svc *s3.S3) (publicBlock, error) {
+	var pb publicBlock
+
+	count.Incr("aws-get-public-access-block")
+
+	out, err := svc.GetPublicAccessBlock(&s3.GetPublicAccessBlockInput{Bucket: aws.String(bucket)})
+
+	switch {
+	case err != nil && isErrCode(err, errCodeNoPublicBlock):
+		count.Incr("bucket-public-access-block-none")
+	case err != nil:
+		logCountErrTag(err, "GetPublicAccessBlock failed "+bucket, bucket)
+
+		return pb, err
+	case out.PublicAccessBlockConfiguration != nil:
+		c := out.PublicAccessBlockConfiguration
+		pb = newPublicBlock(c.BlockPublicAcls, c.IgnorePublicAcls, c.BlockPublicPolicy, c.RestrictPublicBuckets)
+	}
+
+	return pb, nil
+}
+
+// getBucketOwnership returns the Object Ownership setting or "none".
+func getBucketOwnership(bucket string, svc *s3.S3) (string, error) {
+	count.Incr("aws-get-bucket-ownership")
+
+	out, err := svc.GetBucketOwnershipControls(&s3.GetBucketOwnershipControlsInput{Bucket: aws.String(bucket)})
+
+	switch {
+	case err != nil && isErrCode(err, errCodeNoOwnership):
+		return ownershipNotConfigured, nil
+	case err != nil:
+		logCountErrTag(err, "GetBucketOwnershipControls failed "+bucket, bucket)
+
+		return "", err
+	case out.OwnershipControls != nil:
+		for _, r := range out.OwnershipControls.Rules {
+			return aws.StringValue(r.ObjectOwnership), nil
+		}
+	}
+
+	return ownershipNotConfigured, nil
+}
+
+// granteeLabel is a short printable name for a grantee.
+func granteeLabel(g *s3.Grantee) string {
+	switch {
+	case g == nil:
+		return "?"
+	case g.URI != nil:
+		return groupName(aws.StringValue(g.URI))
+	case g.ID != nil:
+		return aws.StringValue(g.ID)
+	default:
+		return aws.StringValue(g.EmailAddress)
+	}
+}
+
+// groupName returns the last part of a group URI, e.g. AllUsers.
+func groupName(uri string) string {
+	return uri[strings.LastIndex(uri, "/")+1:]
+}
+
+// getBucketAccess reads the ACL, ownership, public blocks and policy
+// status of one bucket.
+func getBucketAccess(acctID string, bucket string, region string, sess *session.Session) bucketAccess { //nolint:cyclop
+	svc := s3.New(sess)
+	a := bucketAccess{acctID: resolveAcctID(acctID, sess), bucket: bucket, region: region}
+
+	var err error
+
+	if a.ownership, err = getBucketOwnership(bucket, svc); err != nil {
+		a.errs = append(a.errs, "ownership: "+err.Error())
+	}
+
+	if a.bucketBlock, err = getBucketPublicBlock(bucket, svc); err != nil {
+		a.errs = append(a.errs, "bucket public access block: "+err.Error())
+	}
+
+	if a.acctBlock, err = getAcctPublicBlock(a.acctID, sess); err != nil {
+		a.errs = append(a.errs, "account public access block: "+err.Error())
+	}
+
+	count.Incr("aws-get-bucket-acl")
+
+	acl, err := svc.GetBucketAcl(&s3.GetBucketAclInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		logCountErrTag(err, "GetBucketAcl failed "+bucket, bucket)
+		a.errs = append(a.errs, "acl: "+err.Error())
+	} else {
+		owner := ""
+		if acl.Owner != nil {
+			owner = aws.StringValue(acl.Owner.ID)
+		}
+
+		for _, g := range acl.Grants {
+			if g.Grantee == nil {
+				continue
+			}
+
+			label := granteeLabel(g.Grantee) + ":" + aws.StringValue(g.Permission)
+			uri := aws.StringValue(g.Grantee.URI)
+
+			switch {
+			case uri == groupAllUsers || uri == groupAuthUsers:
+				a.publicGrants = append(a.publicGrants, label)
+			case uri == groupLogDelivery:
+				// log delivery is fine
+			case aws.StringValue(g.Grantee.ID) != owner:
+				a.otherGrants = append(a.otherGrants, label)
+			}
+		}
+	}
+
+	count.Incr("aws-get-bucket-policy-status")
+
+	ps, err := svc.GetBucketPolicyStatus(&s3.GetBucketPolicyStatusInput{Bucket: aws.String(bucket)})
+
+	switch {
+	case err != nil && isErrCode(err, errCodeNoPolicy):
+		// no policy is not public
+	case err != nil:
+		logCountErrTag(err, "GetBucketPolicyStatus failed "+bucket, bucket)
+		a.errs = append(a.errs, "policy status: "+err.Error())
+	case ps.PolicyStatus != nil:
+		a.policyIsPublic = aws.BoolValue(ps.PolicyStatus.IsPublic)
+	}
+
+	return a
+}
+
+// checkBucketAccess writes one access posture row for the bucket and
+// counts public buckets, ACLs still on and public grants.
+func checkBucketAccess(acctID string, bucket string, region string, sess *session.Session) {
+	a := getBucketAccess(acctID, bucket, region, sess)
+
+	if a.isPublic() {
+		count.Incr("access-public-bucket")
+		fmt.Println("ERROR: public bucket", a.acctID, bucket)
+	}
+
+	if a.aclsEnabled() {
+		count.Incr("access-acls-enabled")
+	}
+
+	if len(a.publicGrants) > 0 {
+		count.Incr("access-public-grant")
+		fmt.Println("ERROR: public grant", a.acctID, bucket, a.publicGrants)
+	}
+
+	if len(a.otherGrants) > 0 {
+		count.Incr("access-other-account-grant")
+	}
+
+	if !a.bucketBlock.found && !a.acctBlock.found {
+		count.Incr("access-no-public-access-block")
+	}
+
+	if len(a.errs) > 0 {
+		count.Incr("access-error")
+	}
+
+	log.Println("Bucket access posture", a.row())
+	writeReportRow(theConfig["bucketAccessReport"].StrVal, bucketAccessHeader, a.row())
+}
@@ -52,11 +52,14 @@ func getCanonIDMaybeCall(acct string) (string, bool) {
 
 	theCtx.canonRW.RUnlock()
 
-	if !ok {
-		return canonID, ok
+	if ok {
+		return canonID, canonID != "" // "" is a lookup that failed before
 	}
 
 	sess := getSessForAcct(acct)
+	if sess == nil {
+		return "", false
+	}
 
 	lookupCanonicalIDForAcct(acct, sess)
 	theCtx.canonRW.RLock()
@@ -65,5 +68,24 @@ func getCanonIDMaybeCall(acct string) (string, bool) {
 
 	theCtx.canonRW.RUnlock()
 
-	return canonID, ok
+	return canonID, ok && canonID != ""
+}
+
+// acctForCanonID is the reverse lookup of canonIDMap, returning ""
+// for canonical IDs of accounts we haven't seen.
+func acctForCanonID(canonID string) string {
+	if canonID == "" {
+		return ""
+	}
+
+	theCtx.canonRW.RLock()
+	defer theCtx.canonRW.RUnlock()
+
+	for a, c := range theCtx.canonIDMap {
+		if c == canonID {
+			return a
+		}
+	}
+
+	return ""
 }
@@ -0,0 +1,533 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+	"github.com/scritchley/orc"
+	orcproto "github.com/scritchley/orc/proto"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+const (
+	formatParquet    = "parquet"
+	formatORC        = "orc"
+	parquetBatchRows = 10000
+)
+
+var errReadOnlyFile = errors.New("range read file is read only")
+
+// columnarFormat picks Parquet or ORC from the key's suffix, or "" for
+// a delimited file.
+func columnarFormat(key string) string {
+	k := strings.ToLower(key)
+
+	switch {
+	case strings.HasSuffix(k, ".parquet"), strings.HasSuffix(k, ".parq"), strings.HasSuffix(k, ".pq"):
+		return formatParquet
+	case strings.HasSuffix(k, ".orc"):
+		return formatORC
+	}
+
+	return ""
+}
+
+// s3RangeFile reads an object with ranged GETs, at least
+// rangeReadChunkBytes at a time, so only the footer and the columns
+// asked for are fetched.  It is a parquet source.ParquetFile and an
+// orc.SizedReaderAt.
+type s3RangeFile struct {
+	svc    *s3.S3
+	bucket string
+	key    string
+	size   int64
+	pos    int64
+	buf    []byte
+	bufOff int64
+}
+
+// newS3RangeFile heads the object for its size.
+func newS3RangeFile(bucket string, key string, sess *session.Session) (*s3RangeFile, error) {
+	svc := s3.New(sess)
+
+	count.Incr("aws-head-object-range")
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3RangeFile{svc: svc, bucket: bucket, key: key, size: aws.Int64Value(head.ContentLength)}, nil
+}
+
+// fill makes sure buf holds [off, off+n).
+func (f *s3RangeFile) fill(off int64, n int64) error {
+	if off >= f.bufOff && off+n <= f.bufOff+int64(len(f.buf)) {
+		return nil
+	}
+
+	end := min(off+max(n, int64(theConfig["rangeReadChunkBytes"].IntVal)), f.size)
+
+	count.Incr("aws-get-object-range")
+
+	resp, err := f.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(f.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, end-1)),
+	})
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	count.IncrDelta("bytes-range-read", int64(len(buf)))
+	count.IncrDelta("bytes-range-read-"+f.bucket, int64(len(buf)))
+
+	f.buf, f.bufOff = buf, off
+
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *s3RangeFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	n := min(int64(len(p)), f.size-off)
+
+	if err := f.fill(off, n); err != nil {
+		return 0, err
+	}
+
+	copied := copy(p[:n], f.buf[off-f.bufOff:])
+	if copied < len(p) {
+		return copied, io.EOF
+	}
+
+	return copied, nil
+}
+
+// Size implements orc.SizedReaderAt.
+func (f *s3RangeFile) Size() int64 {
+	return f.size
+}
+
+// Read implements io.Reader.
+func (f *s3RangeFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (f *s3RangeFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+
+	if offset < 0 {
+		return f.pos, fmt.Errorf("seek before start %d", offset) //nolint:err113
+	}
+
+	f.pos = offset
+
+	return f.pos, nil
+}
+
+// Open gives each parquet column reader its own position and buffer.
+func (f *s3RangeFile) Open(_ string) (source.ParquetFile, error) {
+	return &s3RangeFile{svc: f.svc, bucket: f.bucket, key: f.key, size: f.size}, nil
+}
+
+// Close implements io.Closer.
+func (f *s3RangeFile) Close() error {
+	f.buf = nil
+
+	return nil
+}
+
+// Write is not supported.
+func (f *s3RangeFile) Write(_ []byte) (int, error) {
+	return 0, errReadOnlyFile
+}
+
+// Create is not supported.
+func (f *s3RangeFile) Create(_ string) (source.ParquetFile, error) {
+	return nil, errReadOnlyFile
+}
+
+// columnarFile is a Parquet or ORC file read a column at a time.
+type columnarFile interface {
+	columns() []string
+	numRows() int64
+	nullStats(col int) (int64, bool) // null count from the footer, if every block has it
+	holdsText(col int) bool          // could have "", NULL or \N values
+	scan(col int, fn func(v interface{})) error
+	close()
+}
+
+// parquetFile reads leaf columns with the parquet column reader.
+type parquetFile struct {
+	pr    *reader.ParquetReader
+	paths []string // internal paths, same order as names
+	names []string
+}
+
+func (p *parquetFile) columns() []string { return p.names }
+
+func (p *parquetFile) numRows() int64 { return p.pr.GetNumRows() }
+
+// holdsText is true for byte array columns, or if the type isn't known.
+func (p *parquetFile) holdsText(col int) bool {
+	for _, rg := range p.pr.Footer.GetRowGroups() {
+		for _, cc := range rg.GetColumns() {
+			md := cc.GetMetaData()
+			if md != nil && strings.Join(md.GetPathInSchema(), ".") == p.names[col] {
+				return md.GetType() == parquet.Type_BYTE_ARRAY || md.GetType() == parquet.Type_FIXED_LEN_BYTE_ARRAY
+			}
+		}
+	}
+
+	return true
+}
+
+func (p *parquetFile) nullStats(col int) (int64, bool) {
+	var nulls int64
+
+	for _, rg := range p.pr.Footer.GetRowGroups() {
+		found := false
+
+		for _, cc := range rg.GetColumns() {
+			md := cc.GetMetaData()
+			if md == nil || strings.Join(md.GetPathInSchema(), ".") != p.names[col] {
+				continue
+			}
+
+			st := md.GetStatistics()
+			if st == nil || !st.IsSetNullCount() {
+				return 0, false
+			}
+
+			nulls += st.GetNullCount()
+			found = true
+		}
+
+		if !found {
+			return 0, false
+		}
+	}
+
+	return nulls, true
+}
+
+func (p *parquetFile) scan(col int, fn func(v interface{})) error {
+	for read := int64(0); read < p.numRows(); read += parquetBatchRows {
+		vals, _, _, err := p.pr.ReadColumnByPath(p.paths[col], parquetBatchRows)
+		if err != nil {
+			return err
+		}
+
+		if len(vals) == 0 {
+			break
+		}
+
+		for _, v := range vals {
+			fn(v)
+		}
+	}
+
+	return nil
+}
+
+func (p *parquetFile) close() { p.pr.ReadStop() }
+
+// openParquet reads the footer and names the leaf columns by their
+// dotted path under the root.
+func openParquet(f *s3RangeFile) (*parquetFile, error) {
+	pr, err := reader.NewParquetColumnReader(f, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parquetFile{pr: pr}
+
+	for _, in := range pr.SchemaHandler.ValueColumns {
+		ex := strings.Split(pr.SchemaHandler.InPathToExPath[in], common.PAR_GO_PATH_DELIMITER)
+		if len(ex) > 1 {
+			ex = ex[1:] // drop the root
+		}
+
+		p.paths = append(p.paths, in)
+		p.names = append(p.names, strings.Join(ex, "."))
+	}
+
+	return p, nil
+}
+
+// orcFile reads top level columns with the orc cursor.
+type orcFile struct {
+	r *orc.Reader
+}
+
+func (o *orcFile) columns() []string { return o.r.Schema().Columns() }
+
+func (o *orcFile) numRows() int64 { return int64(o.r.NumRows()) }
+
+// holdsText is true unless the column is a number, bool, date or
+// timestamp; flat schemas only, like nullStats.
+func (o *orcFile) holdsText(col int) bool {
+	types := o.r.Schema().Types()
+	if len(types) != len(o.columns())+1 {
+		return true
+	}
+
+	switch types[col+1].GetKind() {
+	case orcproto.Type_BOOLEAN, orcproto.Type_BYTE, orcproto.Type_SHORT, orcproto.Type_INT, orcproto.Type_LONG,
+		orcproto.Type_FLOAT, orcproto.Type_DOUBLE, orcproto.Type_DECIMAL, orcproto.Type_DATE, orcproto.Type_TIMESTAMP:
+		return false
+	}
+
+	return true
+}
+
+// nullStats uses the stripe statistics; only for flat schemas, where
+// column i has type id i+1.  Some writers count nulls in
+// numberOfValues, so stats that say there are nulls but count every
+// row as a value aren't trusted.
+func (o *orcFile) nullStats(col int) (int64, bool) {
+	if len(o.r.Schema().Types()) != len(o.columns())+1 {
+		return 0, false
+	}
+
+	stripes, err := o.r.NumStripes()
+	if err != nil || o.r.Metadata() == nil || len(o.r.Metadata().GetStripeStats()) != stripes {
+		return 0, false
+	}
+
+	var values uint64
+
+	hasNull := false
+
+	for _, ss := range o.r.Metadata().GetStripeStats() {
+		cs := ss.GetColStats()
+		if col+1 >= len(cs) || cs[col+1].NumberOfValues == nil {
+			return 0, false
+		}
+
+		values += cs[col+1].GetNumberOfValues()
+		hasNull = hasNull || cs[col+1].GetHasNull()
+	}
+
+	nulls := o.numRows() - int64(values) //nolint:gosec
+	if nulls < 0 || (hasNull && nulls == 0) {
+		return 0, false
+	}
+
+	return nulls, true
+}
+
+func (o *orcFile) scan(col int, fn func(v interface{})) error {
+	c := o.r.Select(o.columns()[col])
+
+	for c.Stripes() {
+		for c.Next() {
+			fn(c.Row()[0])
+		}
+	}
+
+	return c.Err()
+}
+
+func (o *orcFile) close() { _ = o.r.Close() }
+
+// openColumnar opens the object as a Parquet or ORC file.  The
+// readers panic on some corrupt files, which becomes an error.
+func openColumnar(bucket string, key string, format string, sess *session.Session) (cf columnarFile, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reading %s footer: %v", format, r) //nolint:err113
+		}
+	}()
+
+	f, err := newS3RangeFile(bucket, key, sess)
+	if err != nil {
+		return nil, err
+	}
+
+	count.Incr("columnar-file-" + format)
+
+	if format == formatORC {
+		r, err := orc.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+
+		return &orcFile{r: r}, nil
+	}
+
+	return openParquet(f)
+}
+
+// scanColumn is scan with the reader panics turned into errors.
+func scanColumn(cf columnarFile, col int, fn func(v interface{})) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("scanning column %d: %v", col, r) //nolint:err113
+		}
+	}()
+
+	return cf.scan(col, fn)
+}
+
+// columnarString is the text form of a value; nil is "" so it counts
+// as null.
+func columnarString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
+
+// countNullsColumnar is streamAndCountNulls for Parquet and ORC: the
+// column is found by name, else by index, and scanned with the same
+// isNullValue the TSV path uses.  The footer statistics only count
+// real nulls, so they are used instead only for columns that can't
+// hold "", NULL or \N, and only when every block has them.
+func countNullsColumnar(bucket string, key string, format string, fieldIndex int, fieldName string,
+	sess *session.Session,
+) (nullTally, bool) {
+	cf, err := openColumnar(bucket, key, format, sess)
+	if err != nil {
+		logCountErrTag(err, "open "+format+" failed "+bucket+"/"+key, bucket)
+		count.Incr("null-check-scan-error")
+
+		return nullTally{}, false
+	}
+
+	defer cf.close()
+
+	if fieldName != "" {
+		idx := findFieldIndex(cf.columns(), fieldName)
+		if idx >= 0 {
+			fieldIndex = idx
+			fmt.Println("Found column", fieldName, "at index", fieldIndex, "in", bucket, key)
+			count.Incr("null-check-header-found")
+		} else {
+			fmt.Println("Column", fieldName, "not found in schema, using index", fieldIndex, "in", bucket, key)
+			count.Incr("null-check-header-not-found")
+		}
+	}
+
+	baseName := path.Base(key)
+	rows := cf.numRows()
+
+	count.IncrDelta("row", rows)
+	count.IncrDelta("row-"+bucket, rows)
+	count.IncrDelta("row-"+baseName, rows)
+
+	if fieldIndex < 0 || fieldIndex >= len(cf.columns()) {
+		count.IncrDelta("null-check-field-missing", rows)
+		count.IncrDelta("null-check-field-missing-"+bucket, rows)
+		count.IncrDelta("null-check-field-missing-"+baseName, rows)
+
+		return nullTally{lines: int(rows), missing: int(rows)}, true
+	}
+
+	var (
+		nulls int64
+		ok    bool
+	)
+
+	if !cf.holdsText(fieldIndex) {
+		nulls, ok = cf.nullStats(fieldIndex)
+	}
+
+	if ok {
+		count.Incr("null-check-footer-stats")
+	} else {
+		count.Incr("null-check-column-scan")
+
+		err = scanColumn(cf, fieldIndex, func(v interface{}) {
+			if isNullValue(columnarString(v)) {
+				nulls++
+			}
+		})
+		if err != nil {
+			logCountErrTag(err, "scan "+format+" failed "+bucket+"/"+key, bucket)
+			count.Incr("null-check-scan-error")
+
+			return nullTally{}, false
+		}
+	}
+
+	count.IncrDelta("field-null", nulls)
+	count.IncrDelta("field-null-"+bucket, nulls)
+	count.IncrDelta("field-null-"+baseName, nulls)
+	count.IncrDelta("field-non-null", rows-nulls)
+	count.IncrDelta("field-non-null-"+bucket, rows-nulls)
+	count.IncrDelta("field-non-null-"+baseName, rows-nulls)
+
+	if rows > 0 {
+		count.IncrDelta("null-pct-"+baseName, nulls*perCent/rows)
+	}
+
+	fmt.Println("Scanned", rows, "rows of", format, "column", cf.columns()[fieldIndex], "from", bucket, key)
+	count.IncrDelta("null-check-lines", rows)
+
+	return nullTally{lines: int(rows), null: int(nulls), total: int(rows)}, true
+}
+
+// profileColumnar profiles every column of a Parquet or ORC file, one
+// column at a time so only that column's chunks are read.
+func profileColumnar(bucket string, key string, format string, sess *session.Session) (*tableProfile, error) {
+	cf, err := openColumnar(bucket, key, format, sess)
+	if err != nil {
+		return nil, err
+	}
+
+	defer cf.close()
+
+	t := newTableProfile()
+
+	for i, name := range cf.columns() {
+		if name == "" {
+			name = "col_" + strconv.Itoa(i)
+		}
+
+		c := t.column(name)
+
+		if err := scanColumn(cf, i, func(v interface{}) { c.add(columnarString(v)) }); err != nil {
+			return nil, err
+		}
+	}
+
+	count.IncrDelta("profile-row", cf.numRows())
+	count.IncrDelta("profile-row-"+bucket, cf.numRows())
+
+	return t, nil
+}
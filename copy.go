@@ -28,6 +28,7 @@ func copyOnce(source string,
 	bucketName string,
 	keyNeeded bool,
 	keyID string,
+	dsse bool,
 	sess *session.Session,
 ) (*s3.CopyObjectOutput, error) { // nolint:unparam
 	svc := s3.New(sess)
@@ -35,11 +36,16 @@ func copyOnce(source string,
 	var input *s3.CopyObjectInput
 
 	if keyNeeded {
+		sse := s3.ServerSideEncryptionAwsKms
+		if dsse {
+			sse = s3.ServerSideEncryptionAwsKmsDsse
+		}
+
 		input = &s3.CopyObjectInput{
 			Bucket:               aws.String(bucketName),
 			Key:                  aws.String(dest),
 			CopySource:           aws.String(source),
-			ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+			ServerSideEncryption: aws.String(sse),
 			SSEKMSKeyId:          &keyID,
 		}
 	} else {
@@ -0,0 +1,201 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	codecNone   = "none"
+	codecGzip   = "gzip"
+	codecZstd   = "zstd"
+	codecBzip2  = "bzip2"
+	codecSnappy = "snappy"
+	magicPeek   = 10 // longest magic below
+)
+
+// codecMagic is the first bytes of each format; snappy is the framed
+// format's stream identifier chunk.
+var codecMagic = []struct {
+	codec string
+	magic []byte
+}{
+	{codecGzip, []byte{0x1f, 0x8b}},
+	{codecZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{codecBzip2, []byte("BZh")},
+	{codecSnappy, []byte("\xff\x06\x00\x00sNaPpY")},
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+
+	return n, err
+}
+
+// codecFromEncoding maps a Content-Encoding to a codec.
+func codecFromEncoding(enc string) string {
+	for _, e := range strings.Split(strings.ToLower(enc), ",") {
+		switch strings.TrimSpace(e) {
+		case "gzip", "x-gzip":
+			return codecGzip
+		case "zstd":
+			return codecZstd
+		case "bzip2", "x-bzip2":
+			return codecBzip2
+		case "snappy", "x-snappy-framed":
+			return codecSnappy
+		}
+	}
+
+	return ""
+}
+
+// codecFromKey maps a key's suffix to a codec.
+func codecFromKey(key string) string {
+	k := strings.ToLower(key)
+
+	switch {
+	case strings.HasSuffix(k, ".gz"), strings.HasSuffix(k, ".gzip"):
+		return codecGzip
+	case strings.HasSuffix(k, ".zst"), strings.HasSuffix(k, ".zstd"):
+		return codecZstd
+	case strings.HasSuffix(k, ".bz2"):
+		return codecBzip2
+	case strings.HasSuffix(k, ".sz"), strings.HasSuffix(k, ".snappy"):
+		return codecSnappy
+	}
+
+	return ""
+}
+
+// codecFromMagic sniffs the first bytes of the stream.
+func codecFromMagic(br *bufio.Reader) string {
+	p, _ := br.Peek(magicPeek)
+
+	for _, m := range codecMagic {
+		if bytes.HasPrefix(p, m.magic) {
+			return m.codec
+		}
+	}
+
+	return codecNone
+}
+
+// decodedBody returns a reader over the object's uncompressed bytes,
+// picking the codec from Content-Encoding, then the key's suffix, then
+// the magic bytes.  The returned func closes the decoder and counts
+// the compressed and uncompressed bytes; call it when done.
+func decodedBody(bucket string, key string, resp *s3.GetObjectOutput) (io.Reader, func(), error) {
+	r, _, done, err := decodeBody(bucket, key, resp)
+
+	return r, done, err
+}
+
+// decodeBody is decodedBody that also returns the codec it used.
+func decodeBody(bucket string, key string, resp *s3.GetObjectOutput) (io.Reader, string, func(), error) {
+	raw := &countingReader{r: resp.Body}
+	br := bufio.NewReaderSize(raw, scannerBufSize)
+
+	codec := codecNone
+
+	if theConfig["decompress"].BoolVal {
+		codec = codecFromEncoding(aws.StringValue(resp.ContentEncoding))
+		if codec == "" {
+			codec = codecFromKey(key)
+		}
+
+		if codec == "" {
+			codec = codecFromMagic(br)
+		}
+	}
+
+	var (
+		dec    io.Reader
+		closer func()
+	)
+
+	switch codec {
+	case codecGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		dec, closer = gz, func() { gz.Close() }
+	case codecZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		dec, closer = zr, zr.Close
+	case codecBzip2:
+		dec = bzip2.NewReader(br)
+	case codecSnappy:
+		dec = snappy.NewReader(br)
+	default:
+		dec = br
+	}
+
+	out := &countingReader{r: dec}
+
+	count.Incr("decompress-" + codec)
+
+	done := func() {
+		if closer != nil {
+			closer()
+		}
+
+		count.IncrDelta("bytes-compressed", atomic.LoadInt64(&raw.n))
+		count.IncrDelta("bytes-compressed-"+bucket, atomic.LoadInt64(&raw.n))
+		count.IncrDelta("bytes-uncompressed", atomic.LoadInt64(&out.n))
+		count.IncrDelta("bytes-uncompressed-"+bucket, atomic.LoadInt64(&out.n))
+	}
+
+	return out, codec, done, nil
+}
+
+// nopWriteCloser is a WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encodeWriter compresses into w with the codec.  bzip2 has no
+// writer, so it is an error.
+func encodeWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case codecGzip:
+		return gzip.NewWriter(w), nil
+	case codecZstd:
+		return zstd.NewWriter(w)
+	case codecSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	case codecNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("can't compress with %s", codec) //nolint:err113
+	}
+}
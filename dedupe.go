@@ -0,0 +1,445 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	dedupeScopePrefix = "prefix"
+	dedupeBatch       = 4096 // row hashes checked against the prefix set per lock
+	bloomProbes       = 7
+	minFileBloomBits  = 65536
+	minDupGroup       = 2
+	methodETag        = "etag"
+	methodSHA256      = "sha256"
+)
+
+// dedupeHeader is the header row of the duplicates report.
+var dedupeHeader = []string{
+	"bucket", "scope", "kind", "key", "duplicate_of", "size", "fingerprint", "method", "files", "rows", "duplicate_rows",
+}
+
+// dedupeObj is one object's cheap fingerprint.  sure means the ETag
+// is the MD5 of the content: single part and not KMS or SSE-C.
+type dedupeObj struct {
+	key  string
+	etag string
+	sure bool
+}
+
+// dedupeGroup is the objects of one size in one scope.
+type dedupeGroup struct {
+	scope string
+	size  int64
+}
+
+// rowScope is the row keys seen under one prefix.  used is when it
+// last took rows, for evicting the least recently used.
+type rowScope struct {
+	seen  hashSet
+	files int
+	rows  int64
+	dups  int64
+	used  int64
+}
+
+// dedupeScope is the bucket, or with dedupeScope=prefix the object's
+// "directory".
+func dedupeScope(bucket string, key string) string {
+	if theConfig["dedupeScope"].StrVal == dedupeScopePrefix {
+		return bucket + "/" + path.Dir(key)
+	}
+
+	return bucket
+}
+
+// newRowSet is an exact set, or a bloom filter of bits with
+// dedupeApprox.
+func newRowSet(bits int) hashSet {
+	if theConfig["dedupeApprox"].BoolVal {
+		return newBloom(uint64(bits), bloomProbes) //nolint:gosec
+	}
+
+	return exactSet{}
+}
+
+// fileBloomBits sizes a file's bloom filter at a bit per byte, ten
+// bits a row for rows of ten bytes, up to dedupeFileBloomBits.  A
+// compressed file's size says little about its rows, so it gets the
+// most.
+func fileBloomBits(size int64, compressed bool) int {
+	most := int64(theConfig["dedupeFileBloomBits"].IntVal)
+	if compressed {
+		return int(most)
+	}
+
+	return int(min(max(size, minFileBloomBits), most))
+}
+
+// addDedupeObject records an object's size and ETag for the end of
+// bucket comparison.
+func addDedupeObject(bucket string, key string, head s3.HeadObjectOutput) {
+	etag := aws.StringValue(head.ETag)
+	sse := aws.StringValue(head.ServerSideEncryption)
+	sure := !strings.Contains(etag, "-") &&
+		sse != s3.ServerSideEncryptionAwsKms && sse != s3.ServerSideEncryptionAwsKmsDsse &&
+		aws.StringValue(head.SSECustomerAlgorithm) == ""
+
+	g := dedupeGroup{dedupeScope(bucket, key), aws.Int64Value(head.ContentLength)}
+
+	theCtx.dedupeRW.Lock()
+	defer theCtx.dedupeRW.Unlock()
+
+	groups, ok := theCtx.dedupeObjs[bucket]
+	if !ok {
+		groups = make(map[dedupeGroup][]dedupeObj)
+		theCtx.dedupeObjs[bucket] = groups
+	}
+
+	groups[g] = append(groups[g], dedupeObj{key, etag, sure})
+
+	count.Incr("dedupe-object")
+}
+
+// contentHash streams the object through sha256.
+func contentHash(bucket string, key string, svc *s3.S3) (string, error) {
+	count.Incr("aws-get-object-dedupe")
+
+	resp, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	h := sha256.New()
+
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	count.IncrDelta("dedupe-bytes-hashed", n)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprintGroup returns the objects by fingerprint: by ETag if all
+// of them are sure, else by content hash.
+func fingerprintGroup(bucket string, objs []dedupeObj, svc *s3.S3) (map[string][]string, string) {
+	res := make(map[string][]string)
+	method := methodETag
+
+	for _, o := range objs {
+		if !o.sure {
+			method = methodSHA256
+		}
+	}
+
+	for _, o := range objs {
+		fp := o.etag
+
+		if method == methodSHA256 {
+			h, err := contentHash(bucket, o.key, svc)
+			if err != nil {
+				logCountErrTag(err, "dedupe hash failed "+bucket+"/"+o.key, bucket)
+
+				continue
+			}
+
+			fp = h
+		}
+
+		res[fp] = append(res[fp], o.key)
+	}
+
+	return res, method
+}
+
+// finishDedupeObjects reports the duplicate objects in the bucket:
+// objects of the same size in the same scope with the same
+// fingerprint.  Each duplicate names the first key of its set.
+func finishDedupeObjects(bucket string, sess *session.Session) {
+	theCtx.dedupeRW.Lock()
+	groups := theCtx.dedupeObjs[bucket]
+	delete(theCtx.dedupeObjs, bucket)
+	theCtx.dedupeRW.Unlock()
+
+	svc := s3.New(sess)
+	dups := 0
+
+	for g, objs := range groups {
+		if len(objs) < minDupGroup {
+			continue
+		}
+
+		count.Incr("dedupe-size-collision")
+
+		byFP, method := fingerprintGroup(bucket, objs, svc)
+
+		for fp, keys := range byFP {
+			if len(keys) < minDupGroup {
+				continue
+			}
+
+			sort.Strings(keys)
+
+			for _, k := range keys[1:] {
+				dups++
+
+				count.Incr("dedupe-duplicate-object")
+				count.Incr("dedupe-duplicate-object-" + bucket)
+				count.IncrDelta("dedupe-duplicate-bytes", g.size)
+				writeReportRow(theConfig["dedupeReport"].StrVal, dedupeHeader, []string{
+					bucket, g.scope, "object", k, keys[0], strconv.FormatInt(g.size, 10), fp, method, "", "", "",
+				})
+			}
+		}
+	}
+
+	log.Println("Dedupe", bucket, dups, "duplicate objects")
+}
+
+// rowKeyHash hashes the dedupe key: one column, or the whole row.
+func rowKeyHash(rec *record, col int) (uint64, bool) {
+	if col < 0 {
+		return hashString(rec.raw), true
+	}
+
+	if col >= len(rec.fields) {
+		return 0, false
+	}
+
+	return hashString(rec.fields[col]), true
+}
+
+// reportRowScope writes a prefix's rows and duplicate rows.
+func reportRowScope(bucket string, scope string, rs *rowScope, kind string) {
+	method := "exact"
+	if theConfig["dedupeApprox"].BoolVal {
+		method = "bloom"
+	}
+
+	writeReportRow(theConfig["dedupeReport"].StrVal, dedupeHeader, []string{
+		bucket, scope, kind, "", "", "", "", method, strconv.Itoa(rs.files),
+		strconv.FormatInt(rs.rows, 10), strconv.FormatInt(rs.dups, 10),
+	})
+}
+
+// evictRowScope drops the least recently used prefix set, over all
+// buckets, so at most dedupeMaxScopes are held.  Objects are listed
+// in key order so a prefix's files mostly come together; rows of an
+// evicted prefix that turn up later start a new set.  Must hold
+// dedupeRW.  Returns what was evicted, for reporting after unlocking.
+func evictRowScope() (string, string, *rowScope) {
+	var (
+		oldB, oldS string
+		old        *rowScope
+	)
+
+	for b, scopes := range theCtx.dedupeRows {
+		for s, rs := range scopes {
+			if old == nil || rs.used < old.used {
+				oldB, oldS, old = b, s, rs
+			}
+		}
+	}
+
+	if old != nil {
+		delete(theCtx.dedupeRows[oldB], oldS)
+
+		theCtx.dedupeLive--
+
+		count.Incr("dedupe-scope-evicted")
+	}
+
+	return oldB, oldS, old
+}
+
+// checkPrefixRows tests a batch of row hashes against the prefix set
+// and returns how many were already there.  fileDone counts the file
+// in the prefix.
+func checkPrefixRows(bucket string, scope string, hashes []uint64, fileDone bool) int64 {
+	theCtx.dedupeRW.Lock()
+
+	scopes, ok := theCtx.dedupeRows[bucket]
+	if !ok {
+		scopes = make(map[string]*rowScope)
+		theCtx.dedupeRows[bucket] = scopes
+	}
+
+	var (
+		evB, evS string
+		ev       *rowScope
+	)
+
+	rs, ok := scopes[scope]
+	if !ok {
+		if theCtx.dedupeLive >= max(theConfig["dedupeMaxScopes"].IntVal, 1) {
+			evB, evS, ev = evictRowScope()
+		}
+
+		rs = &rowScope{seen: newRowSet(theConfig["dedupeBloomBits"].IntVal)}
+		scopes[scope] = rs
+		theCtx.dedupeLive++
+	}
+
+	var dups int64
+
+	for _, h := range hashes {
+		if rs.seen.testAndAdd(h) {
+			dups++
+		}
+	}
+
+	theCtx.dedupeTick++
+
+	rs.used = theCtx.dedupeTick
+	rs.rows += int64(len(hashes))
+	rs.dups += dups
+
+	if fileDone {
+		rs.files++
+	}
+
+	theCtx.dedupeRW.Unlock()
+
+	if ev != nil {
+		reportRowScope(evB, evS, ev, "rows-in-prefix-evicted")
+	}
+
+	return dups
+}
+
+// dedupeRowsInObject streams one file and counts rows whose key was
+// already seen in the file and in its prefix.
+func dedupeRowsInObject(bucket string, key string, sess *session.Session) { //nolint:cyclop
+	count.Incr("aws-get-object")
+
+	resp, err := s3.New(sess).GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		logCountErrTag(err, "GetObject failed "+bucket+"/"+key, bucket)
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	body, done, err := decodedBody(bucket, key, resp)
+	if err != nil {
+		log.Println("Error decompressing object", bucket, key, err)
+		count.Incr("dedupe-decompress-error")
+
+		return
+	}
+
+	defer done()
+
+	keyCol := theConfig["dedupeKeyColumn"].StrVal
+	col := theConfig["dedupeKeyIndex"].IntVal
+	d := dialectFor("dedupeDelimiter", keyCol != "", key)
+	rr := newRecordReader(body, d)
+	fileSet := newRowSet(fileBloomBits(aws.Int64Value(resp.ContentLength),
+		codecFromEncoding(aws.StringValue(resp.ContentEncoding)) != "" || codecFromKey(key) != ""))
+	scope := dedupeScope(bucket, key)
+	batch := make([]uint64, 0, dedupeBatch)
+	needHeader := d.hasHeader
+
+	var rows, fileDups, prefixDups int64
+
+	for {
+		rec, err := rr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil && !countMalformed(err, "dedupe", bucket, key) {
+			log.Println("Error scanning object", bucket, key, err)
+			count.Incr("dedupe-scan-error")
+
+			return
+		}
+
+		if needHeader {
+			needHeader = false
+
+			if keyCol != "" {
+				col = findFieldIndex(rec.fields, keyCol)
+				if col < 0 {
+					fmt.Println("Dedupe key column", keyCol, "not in header, using whole rows in", bucket, key)
+					count.Incr("dedupe-key-column-not-found")
+				}
+			}
+
+			continue
+		}
+
+		h, ok := rowKeyHash(rec, col)
+		if !ok {
+			count.Incr("dedupe-key-missing")
+
+			continue
+		}
+
+		rows++
+
+		if fileSet.testAndAdd(h) {
+			fileDups++
+		}
+
+		if batch = append(batch, h); len(batch) == dedupeBatch {
+			prefixDups += checkPrefixRows(bucket, scope, batch, false)
+			batch = batch[:0]
+		}
+	}
+
+	prefixDups += checkPrefixRows(bucket, scope, batch, true)
+
+	count.IncrDelta("dedupe-rows", rows)
+	count.IncrDelta("dedupe-duplicate-rows-in-file", fileDups)
+	count.IncrDelta("dedupe-duplicate-rows-in-file-"+bucket, fileDups)
+	count.IncrDelta("dedupe-duplicate-rows-in-prefix", prefixDups-fileDups)
+
+	method := "exact"
+	if theConfig["dedupeApprox"].BoolVal {
+		method = "bloom"
+	}
+
+	if fileDups > 0 {
+		fmt.Println("Duplicate rows", fileDups, "of", rows, "in", bucket, key)
+	}
+
+	writeReportRow(theConfig["dedupeReport"].StrVal, dedupeHeader, []string{
+		bucket, scope, "rows-in-file", key, "", "", "", method, "1",
+		strconv.FormatInt(rows, 10), strconv.FormatInt(fileDups, 10),
+	})
+}
+
+// finishDedupeRows reports each prefix's rows and duplicate rows.
+func finishDedupeRows(bucket string) {
+	theCtx.dedupeRW.Lock()
+	scopes := theCtx.dedupeRows[bucket]
+	delete(theCtx.dedupeRows, bucket)
+	theCtx.dedupeLive -= len(scopes)
+	theCtx.dedupeRW.Unlock()
+
+	for scope, rs := range scopes {
+		reportRowScope(bucket, scope, rs, "rows-in-prefix")
+	}
+}
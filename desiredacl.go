@@ -0,0 +1,339 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	aclRuleFields = 3
+	anyScope      = "*"
+	forbidPrefix  = "!"
+)
+
+// aclDiffHeader is the header row of the desired ACL report.
+var aclDiffHeader = []string{"bucket", "key", "grantee", "permission", "issue", "action"}
+
+// aclPerms are the object ACL permissions, in report order.
+var aclPerms = []string{
+	s3.PermissionRead, s3.PermissionReadAcp, s3.PermissionWrite, s3.PermissionWriteAcp, s3.PermissionFullControl,
+}
+
+var (
+	acctIDOnlyRe = regexp.MustCompile(`^\d{12}$`)
+	canonIDRe    = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// aclRule is one line of the desired ACL spec: under scope (bucket,
+// bucket/prefix or *) grantee must have perms, or if forbid is set
+// must have no grant at all.  Grants no rule names are left alone.
+type aclRule struct {
+	scope   string
+	grantee string
+	perms   []string
+	forbid  bool
+}
+
+// aclWant is a grant the object must have or must not have, with the
+// grantee resolved to a canonical ID or group URI.
+type aclWant struct {
+	label string
+	id    string
+	uri   string
+	perm  string
+}
+
+// matches is true if the grant is to this grantee.
+func (w aclWant) matches(g *s3.Grant) bool {
+	if g == nil || g.Grantee == nil {
+		return false
+	}
+
+	if w.uri != "" {
+		return aws.StringValue(g.Grantee.URI) == w.uri
+	}
+
+	return aws.StringValue(g.Grantee.ID) == w.id
+}
+
+// grantee makes the s3 Grantee for the want.
+func (w aclWant) grantee() *s3.Grantee {
+	if w.uri != "" {
+		return &s3.Grantee{Type: aws.String(s3.TypeGroup), URI: aws.String(w.uri)}
+	}
+
+	return &s3.Grantee{Type: aws.String(s3.TypeCanonicalUser), ID: aws.String(w.id)}
+}
+
+// parseACLRule parses "<scope> <grantee> <PERM,PERM>" or
+// "<scope> !<grantee>".
+func parseACLRule(line string) (aclRule, error) {
+	f := strings.Fields(line)
+
+	if len(f) == aclRuleFields-1 && strings.HasPrefix(f[1], forbidPrefix) {
+		return aclRule{scope: f[0], grantee: strings.TrimPrefix(f[1], forbidPrefix), forbid: true}, nil
+	}
+
+	if len(f) != aclRuleFields {
+		return aclRule{}, fmt.Errorf("want 3 fields: %s", line) //nolint:err113
+	}
+
+	r := aclRule{scope: f[0], grantee: f[1]}
+
+	for _, p := range strings.Split(f[2], ",") {
+		p = strings.ToUpper(strings.TrimSpace(p))
+
+		switch p {
+		case s3.PermissionRead, s3.PermissionReadAcp, s3.PermissionWrite,
+			s3.PermissionWriteAcp, s3.PermissionFullControl:
+			r.perms = append(r.perms, p)
+		default:
+			return aclRule{}, fmt.Errorf("unknown permission %s: %s", p, line) //nolint:err113
+		}
+	}
+
+	return r, nil
+}
+
+// readDesiredACLFile reads the desired ACL spec, one rule per line.
+func readDesiredACLFile(filename string) ([]aclRule, error) {
+	var rules []aclRule
+
+	if len(filename) == 0 {
+		return rules, nil
+	}
+
+	binaryFilename, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	filePath := path.Join(path.Dir(binaryFilename), filename)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Println("Warning: can't open desired acl file", filename, filePath, err.Error())
+
+		return rules, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[:1] == "#" {
+			continue
+		}
+
+		r, err := parseACLRule(line)
+		if err != nil {
+			fmt.Println("Skipping bad desired acl line", filename, lineNum, err)
+
+			continue
+		}
+
+		fmt.Println("Adding desired acl rule", r)
+		rules = append(rules, r)
+	}
+
+	return rules, scanner.Err()
+}
+
+// threeACLRules turns the old threeAcctAclReader list into rules:
+// every account gets FULL_CONTROL everywhere.
+func threeACLRules() []aclRule {
+	var rules []aclRule
+
+	for _, a := range strings.Split(theConfig["threeAcctAclReader"].StrVal, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			rules = append(rules, aclRule{scope: anyScope, grantee: a, perms: []string{s3.PermissionFullControl}})
+		}
+	}
+
+	return rules
+}
+
+// resolveGrantee turns an account ID, canonical ID or group name into
+// an aclWant.  Returns false if an account's canonical ID is unknown.
+func resolveGrantee(g string) (aclWant, bool) {
+	w := aclWant{label: g}
+
+	switch {
+	case strings.HasPrefix(g, "http://acs.amazonaws.com/groups/"):
+		w.uri = g
+	case g == groupName(groupAllUsers):
+		w.uri = groupAllUsers
+	case g == groupName(groupAuthUsers):
+		w.uri = groupAuthUsers
+	case g == groupName(groupLogDelivery):
+		w.uri = groupLogDelivery
+	case canonIDRe.MatchString(g):
+		w.id = g
+	case acctIDOnlyRe.MatchString(g):
+		id, ok := getCanonIDMaybeCall(g)
+		if !ok {
+			return w, false
+		}
+
+		w.id = id
+	default:
+		return w, false
+	}
+
+	return w, true
+}
+
+// scopeCovers is true if scope is *, the bucket, or bucket/prefix
+// where the prefix ends at a / in the key: bucket/logs covers
+// bucket/logs/a but not bucket/logs2/a or bucket2.
+func scopeCovers(scope string, full string) bool {
+	if scope == anyScope || scope == full {
+		return true
+	}
+
+	if !strings.HasSuffix(scope, "/") {
+		scope += "/"
+	}
+
+	return strings.HasPrefix(full, scope)
+}
+
+// rulesFor returns the rules whose scope covers bucket/key.
+func rulesFor(rules []aclRule, bucket string, key string) []aclRule {
+	var res []aclRule
+
+	full := bucket + "/" + key
+
+	for _, r := range rules {
+		if scopeCovers(r.scope, full) {
+			res = append(res, r)
+		}
+	}
+
+	return res
+}
+
+// hasPerm is true if a grant to w gives exactly perm.
+func hasPerm(grants []*s3.Grant, w aclWant, perm string) bool {
+	for _, g := range grants {
+		if w.matches(g) && aws.StringValue(g.Permission) == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// specGrantee is a grantee the rules name, with every permission the
+// rules covering the object give it.
+type specGrantee struct {
+	want  aclWant
+	perms map[string]bool
+}
+
+// diffACL compares the actual ACL with the rules and returns the
+// grants to add, the grants of forbidden grantees and the grants to
+// named grantees of permissions the rules don't give them.  The rules
+// are exact: FULL_CONTROL doesn't stand in for READ, and a grantee
+// specced as READ that holds FULL_CONTROL has an extra grant.
+func diffACL(acl s3.GetObjectAclOutput, rules []aclRule) ([]aclWant, []aclWant, []aclWant) { //nolint:cyclop
+	var (
+		missing, forbidden, extra []aclWant
+		specs                     []*specGrantee
+	)
+
+	byLabel := make(map[string]*specGrantee)
+
+	for _, r := range rules {
+		w, ok := resolveGrantee(r.grantee)
+		if !ok {
+			fmt.Println("Can't resolve grantee, skipping", r.grantee)
+			count.Incr("desired-acl-unresolved-grantee")
+
+			continue
+		}
+
+		if r.forbid {
+			for _, g := range acl.Grants {
+				if w.matches(g) {
+					w.perm = aws.StringValue(g.Permission)
+					forbidden = append(forbidden, w)
+				}
+			}
+
+			continue
+		}
+
+		sg, ok := byLabel[w.id+w.uri]
+		if !ok {
+			sg = &specGrantee{want: w, perms: make(map[string]bool)}
+			byLabel[w.id+w.uri] = sg
+			specs = append(specs, sg)
+		}
+
+		for _, p := range r.perms {
+			sg.perms[p] = true
+		}
+	}
+
+	for _, sg := range specs {
+		for _, p := range aclPerms {
+			if sg.perms[p] && !hasPerm(acl.Grants, sg.want, p) {
+				w := sg.want
+				w.perm = p
+				missing = append(missing, w)
+			}
+		}
+
+		for _, g := range acl.Grants {
+			if p := aws.StringValue(g.Permission); sg.want.matches(g) && !sg.perms[p] {
+				w := sg.want
+				w.perm = p
+				extra = append(extra, w)
+			}
+		}
+	}
+
+	return missing, forbidden, extra
+}
+
+// applyACLDiff makes the new ACL: the old grants less the ones to
+// remove, matched on grantee and permission, plus the missing grants.
+func applyACLDiff(acl s3.GetObjectAclOutput, missing []aclWant, remove []aclWant) s3.AccessControlPolicy {
+	newACL := s3.AccessControlPolicy{Owner: acl.Owner}
+
+	for _, g := range acl.Grants {
+		drop := false
+
+		for _, w := range remove {
+			if w.matches(g) && w.perm == aws.StringValue(g.Permission) {
+				drop = true
+			}
+		}
+
+		if !drop {
+			newACL.Grants = append(newACL.Grants, g)
+		}
+	}
+
+	for _, w := range missing {
+		newACL.Grants = append(newACL.Grants, &s3.Grant{Grantee: w.grantee(), Permission: aws.String(w.perm)})
+	}
+
+	return newACL
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	count "github.com/jayalane/go-counter"
@@ -22,8 +23,68 @@ func keyName(bucket string,
 	return bs
 }
 
-// given a bucket and head check if the encryption is ok.
-func isObjectEncOk(b string, head s3.HeadObjectOutput) bool {
+// the kinds of object encryption we tell apart.
+const (
+	encTypeNone   = "none"
+	encTypeSSES3  = "SSE-S3"
+	encTypeSSEKMS = "SSE-KMS"
+	encTypeDSSE   = "DSSE-KMS"
+	encTypeSSEC   = "SSE-C"
+	encTypeOther  = "other"
+)
+
+// encTypeHeader is the header row of the unusual encryption report.
+var encTypeHeader = []string{"bucket", "key", "enc_type", "kms_key", "reason"}
+
+// objectEncType classifies the encryption a HeadObject reports.
+func objectEncType(head s3.HeadObjectOutput) string {
+	if head.SSECustomerAlgorithm != nil {
+		return encTypeSSEC
+	}
+
+	switch aws.StringValue(head.ServerSideEncryption) {
+	case "":
+		return encTypeNone
+	case s3.ServerSideEncryptionAes256:
+		return encTypeSSES3
+	case s3.ServerSideEncryptionAwsKms:
+		return encTypeSSEKMS
+	case s3.ServerSideEncryptionAwsKmsDsse:
+		return encTypeDSSE
+	default:
+		return encTypeOther
+	}
+}
+
+// reportEncType counts the object's encryption type and writes SSE-C
+// and DSSE-KMS objects to the report as they need special handling.
+func reportEncType(b string, k string, encType string, kmsKey string, reason string) {
+	count.Incr("enc-type-" + encType)
+	count.Incr("enc-type-" + encType + "-" + b)
+
+	if encType == encTypeSSEC || encType == encTypeDSSE {
+		writeReportRow(theConfig["encTypeReport"].StrVal, encTypeHeader,
+			[]string{b, k, encType, kmsKey, reason})
+	}
+}
+
+// reportEncFinding writes an object that is wrong but that
+// reencrypting can't fix to the unusual encryption report.
+func reportEncFinding(b string, k string, head s3.HeadObjectOutput, reason string) {
+	count.Incr("encrypt-not-fixable")
+	count.Incr("encrypt-not-fixable-" + b)
+	writeReportRow(theConfig["encTypeReport"].StrVal, encTypeHeader,
+		[]string{b, k, objectEncType(head), aws.StringValue(head.SSEKMSKeyId), reason})
+}
+
+// given a bucket and head check if the encryption is ok.  Keys are
+// compared by their canonical KMS ARNs and must be enabled and owned
+// by an allowed account.  The second result is false when the object
+// is bad but reencrypting with the bucket's key can't fix it: SSE-C,
+// or the bucket's key is disabled or in an account that isn't allowed.
+func isObjectEncOk(b string, k string, acctID string, //nolint:cyclop
+	head s3.HeadObjectOutput, sess *session.Session,
+) (bool, bool) {
 	keyID := ""
 	hasKeyID := false
 
@@ -35,46 +96,93 @@ func isObjectEncOk(b string, head s3.HeadObjectOutput) bool {
 
 	if hasKeyID {
 		// must be encrypted and right key id
+		if head.SSECustomerAlgorithm != nil {
+			count.Incr("encrypt-sse-c-fail") // can't be the bucket's KMS key
+
+			return false, false
+		}
+
 		if head.ServerSideEncryption == nil {
 			count.Incr("encrypt-no-server-side-fail")
 
-			return false
+			return false, true
 		}
 
-		if *head.ServerSideEncryption != "aws:kms" {
+		if *head.ServerSideEncryption != s3.ServerSideEncryptionAwsKms &&
+			*head.ServerSideEncryption != s3.ServerSideEncryptionAwsKmsDsse {
 			count.Incr("encrypt-no-server-side-kms")
 
-			return false
+			return false, true
+		}
+
+		if head.SSEKMSKeyId == nil {
+			count.Incr("encrypt-no-kms-key-id-fail")
+
+			return false, true
 		}
 
-		if !strings.Contains(*head.SSEKMSKeyId, keyID) {
+		region := aws.StringValue(sess.Config.Region)
+		acctID = resolveAcctID(acctID, sess)
+		want := resolveKMSKey(keyID, acctID, region, sess)
+		got := resolveKMSKey(*head.SSEKMSKeyId, acctID, region, sess)
+
+		mismatch := !sameKMSKey(want, got)
+		if mismatch {
 			count.Incr("encrypt-keymismatch-fail")
+		}
 
-			return false
+		// the bucket's key is what a reencrypt would use, so if it's
+		// bad that's a finding, not something to copy over again
+		if !want.usable() {
+			count.Incr("encrypt-key-state-fail")
+			count.Incr("encrypt-key-state-" + want.state)
+			fmt.Println("ERROR: kms key not usable", b, want.arn, want.state)
+			reportEncFinding(b, k, head, "bucket kms key not usable: "+want.state)
+
+			return false, false
+		}
+
+		if !kmsAcctAllowed(want.acctID, acctID) {
+			count.Incr("encrypt-key-unexpected-account")
+			fmt.Println("ERROR: kms key in unexpected account", b, want.arn, want.acctID)
+			reportEncFinding(b, k, head, "bucket kms key in unexpected account "+want.acctID)
+
+			return false, false
+		}
+
+		if mismatch {
+			return false, true
+		}
+
+		if *head.ServerSideEncryption == s3.ServerSideEncryptionAwsKmsDsse {
+			count.Incr("encrypt-check-ok-dsse")
 		}
 
 		count.Incr("encrypt-check-ok-kms")
 
-		return true
+		return true, true
 	}
 
 	// no keyID so just needs to be something
-	if head.ServerSideEncryption == nil {
+	if head.ServerSideEncryption == nil && head.SSECustomerAlgorithm == nil {
 		count.Incr("encrypt-no-sse-fail")
 
-		return false
+		return false, true
 	}
 
 	count.Incr("encrypt-no-key-id-for-bucket-ok")
 
-	return true
+	return true, true
 }
 
 // given a bucket, an object, and a session, reencrypt it
-// returns true if the error is retryable.
-func reencryptObject(bucketName string,
+// returns true if the error is retryable.  SSE-C objects can't be
+// copied without the customer key so they are skipped; DSSE-KMS
+// objects stay DSSE-KMS.
+func reencryptObject(bucketName string, //nolint:cyclop
 	objectName string,
 	keyNeeded bool,
+	head s3.HeadObjectOutput,
 	sess *session.Session,
 ) bool {
 	if strings.HasSuffix(objectName, "%%%") {
@@ -83,6 +191,18 @@ func reencryptObject(bucketName string,
 		return false
 	}
 
+	encType := objectEncType(head)
+
+	if encType == encTypeSSEC {
+		fmt.Println("Skipping SSE-C object, can't copy without the customer key", bucketName, objectName)
+		count.Incr("skip-encrypt-sse-c")
+		reportEncType(bucketName, objectName, encType, "", "skipped copy: SSE-C needs customer key")
+
+		return false
+	}
+
+	dsse := encType == encTypeDSSE
+
 	if theConfig["reCopyFiles"].BoolVal {
 		// keep track.  re-encrypt, the state is in the object
 		// for recopying all it is not (maybe mod time but ...
@@ -104,7 +224,12 @@ func reencryptObject(bucketName string,
 
 	theCtx.keyRW.RUnlock()
 
-	if !hasKeyID && keyNeeded {
+	if dsse && !hasKeyID {
+		keyID = aws.StringValue(head.SSEKMSKeyId) // keep its own key rather than downgrade
+		keyNeeded = true
+	}
+
+	if !hasKeyID && keyNeeded && !dsse {
 		count.Incr("skip-encryp-no-keyid")
 
 		return false // not retryable
@@ -119,6 +244,7 @@ func reencryptObject(bucketName string,
 		bucketName,
 		keyNeeded,
 		keyID,
+		dsse,
 		sess)
 	if err != nil {
 		// logging done
@@ -137,6 +263,7 @@ func reencryptObject(bucketName string,
 		bucketName,
 		keyNeeded,
 		keyID,
+		dsse,
 		sess)
 	if err != nil {
 		// logging done
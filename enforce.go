@@ -0,0 +1,291 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	denyUnencryptedSid = "DenyUnencryptedObjectUploads"
+	keyTargetFields    = 2
+)
+
+// enforceHeader is the header row of the remediation report.
+var enforceHeader = []string{
+	"account", "bucket", "region", "target_key", "action",
+	"before_sse_algorithm", "before_kms_key", "before_bucket_key_enabled", "before_policy_denies_unencrypted",
+	"after_sse_algorithm", "after_kms_key", "after_bucket_key_enabled", "after_policy_denies_unencrypted",
+	"error",
+}
+
+// readKeyTargetFile reads the "<account or bucket> <kms key>" lines
+// that say which KMS key each bucket should default to.
+func readKeyTargetFile(filename string) (map[string]string, error) {
+	targets := make(map[string]string)
+
+	if len(filename) == 0 {
+		return targets, nil
+	}
+
+	binaryFilename, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	filePath := path.Join(path.Dir(binaryFilename), filename)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Println("Warning: can't open kms key target file, using default,",
+			filename, filePath, err.Error())
+
+		return targets, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[:1] == "#" {
+			continue
+		}
+
+		f := strings.Fields(line)
+		if len(f) != keyTargetFields {
+			fmt.Println("Skipping bad kms key target line", filename, lineNum, line)
+
+			continue
+		}
+
+		fmt.Println("Adding kms key target", f[0], f[1])
+		targets[f[0]] = f[1]
+	}
+
+	return targets, scanner.Err()
+}
+
+// targetKeyFor returns the KMS key a bucket should use: a bucket entry
+// wins over an account entry which wins over enforceKmsKeyDefault.
+func targetKeyFor(acctID string, bucket string) string {
+	if k, ok := theCtx.keyTargets[bucket]; ok {
+		return k
+	}
+
+	if k, ok := theCtx.keyTargets[acctID]; ok {
+		return k
+	}
+
+	return theConfig["enforceKmsKeyDefault"].StrVal
+}
+
+// denyUnencryptedStatement makes the bucket policy statement that
+// refuses PUTs without a KMS SSE header.
+func denyUnencryptedStatement(bucket string) policyStatement {
+	return policyStatement{
+		Sid:       denyUnencryptedSid,
+		Effect:    "Deny",
+		Principal: json.RawMessage(`"*"`),
+		Action:    stringOrSlice{"s3:PutObject"},
+		Resource:  stringOrSlice{"arn:aws:s3:::" + bucket + "/*"},
+		Condition: map[string]map[string]stringOrSlice{
+			"StringNotEquals": {
+				sseHeaderKey: {s3.ServerSideEncryptionAwsKms, s3.ServerSideEncryptionAwsKmsDsse},
+			},
+		},
+	}
+}
+
+// spliceDenyUnencrypted puts the deny statement into the policy JSON in
+// place of our old one if any.  The rest of the policy is kept as raw
+// JSON, so fields and types policyDoc doesn't model come through.
+func spliceDenyUnencrypted(policy []byte, bucket string) ([]byte, error) {
+	doc := map[string]json.RawMessage{}
+
+	if policy == nil {
+		doc["Version"] = json.RawMessage(strconv.Quote(policyVersion2012))
+	} else if err := json.Unmarshal(policy, &doc); err != nil {
+		return nil, err
+	}
+
+	var stmts []json.RawMessage
+
+	if st := bytes.TrimSpace(doc["Statement"]); len(st) > 0 {
+		if st[0] == '{' {
+			stmts = []json.RawMessage{st}
+		} else if err := json.Unmarshal(st, &stmts); err != nil {
+			return nil, err
+		}
+	}
+
+	kept := make([]json.RawMessage, 0, len(stmts)+1)
+
+	for _, st := range stmts {
+		var id struct{ Sid string }
+
+		if err := json.Unmarshal(st, &id); err != nil {
+			return nil, err
+		}
+
+		if id.Sid != denyUnencryptedSid { // replace our old one if any
+			kept = append(kept, st)
+		}
+	}
+
+	ours, err := json.Marshal(denyUnencryptedStatement(bucket))
+	if err != nil {
+		return nil, err
+	}
+
+	doc["Statement"], err = json.Marshal(append(kept, ours))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(doc)
+}
+
+// putDenyUnencryptedPolicy adds the deny statement to whatever policy
+// the bucket already has.
+func putDenyUnencryptedPolicy(bucket string, svc *s3.S3) error {
+	b, err := getBucketPolicyJSON(bucket, svc)
+	if err != nil {
+		return err
+	}
+
+	b, err = spliceDenyUnencrypted(b, bucket)
+	if err != nil {
+		count.Incr("bucket-policy-parse-error")
+
+		return err
+	}
+
+	count.Incr("aws-put-bucket-policy")
+
+	_, err = svc.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(bucket),
+		Policy: aws.String(string(b)),
+	})
+	if err != nil {
+		logCountErrTag(err, "PutBucketPolicy failed "+bucket, bucket)
+	}
+
+	return err
+}
+
+// putDefaultKMS sets the bucket default encryption to keyID with
+// S3 Bucket Keys on.
+func putDefaultKMS(bucket string, keyID string, svc *s3.S3) error {
+	count.Incr("aws-put-bucket-enc")
+
+	_, err := svc.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: aws.String(bucket),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{{
+				ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+					SSEAlgorithm:   aws.String(s3.ServerSideEncryptionAwsKms),
+					KMSMasterKeyID: aws.String(keyID),
+				},
+				BucketKeyEnabled: aws.Bool(true),
+			}},
+		},
+	})
+	if err != nil {
+		logCountErrTag(err, "PutBucketEncryption failed "+bucket, bucket)
+	}
+
+	return err
+}
+
+// enforceBucketEncryption makes the bucket default to the target KMS
+// key with Bucket Keys on and a deny-unencrypted policy.  Without
+// readOnly and setToDangerToEnforceEncryption set to danger it only
+// reports what it would do.  Every bucket gets a before/after row.
+func enforceBucketEncryption(acctID string, bucket string, region string, sess *session.Session) { //nolint:cyclop
+	svc := s3.New(sess)
+	before := getBucketEncPosture(acctID, bucket, region, sess)
+	after := before
+	keyID := targetKeyFor(before.acctID, bucket)
+
+	var errs []string
+
+	action := "ok"
+	needEnc := before.algorithm != s3.ServerSideEncryptionAwsKms ||
+		!before.bucketKeyEnabled ||
+		(keyID != "" && !sameKMSKey(
+			resolveKMSKey(before.kmsKey, before.acctID, region, sess),
+			resolveKMSKey(keyID, before.acctID, region, sess)))
+	needPolicy := !before.policyDeniesUnencrypted
+
+	switch {
+	case keyID == "":
+		action = "skip-no-target-key"
+
+		count.Incr("enforce-no-target-key")
+	case !needEnc && !needPolicy:
+		count.Incr("enforce-already-ok")
+	case theConfig["readOnly"].StrVal != danger ||
+		theConfig["setToDangerToEnforceEncryption"].StrVal != danger:
+		action = "dry-run"
+
+		fmt.Println("Would enforce encryption", bucket, keyID, "encryption", needEnc, "policy", needPolicy)
+		count.Incr("enforce-dry-run")
+	default:
+		action = "enforced"
+
+		if needEnc {
+			if err := putDefaultKMS(bucket, keyID, svc); err != nil {
+				errs = append(errs, "encryption: "+err.Error())
+			} else {
+				count.Incr("enforce-put-encryption")
+			}
+		}
+
+		if needPolicy {
+			if err := putDenyUnencryptedPolicy(bucket, svc); err != nil {
+				errs = append(errs, "policy: "+err.Error())
+			} else {
+				count.Incr("enforce-put-policy")
+			}
+		}
+
+		after = getBucketEncPosture(acctID, bucket, region, sess)
+
+		if len(errs) > 0 {
+			action = "failed"
+
+			count.Incr("enforce-failed")
+		} else {
+			fmt.Println("Successfully enforced encryption", bucket, keyID)
+		}
+	}
+
+	log.Println("Bucket encryption enforce", bucket, action)
+	writeReportRow(theConfig["enforceReport"].StrVal, enforceHeader, []string{
+		before.acctID, bucket, region, keyID, action,
+		before.algorithm, before.kmsKey,
+		strconv.FormatBool(before.bucketKeyEnabled), strconv.FormatBool(before.policyDeniesUnencrypted),
+		after.algorithm, after.kmsKey,
+		strconv.FormatBool(after.bucketKeyEnabled), strconv.FormatBool(after.policyDeniesUnencrypted),
+		strings.Join(slices.Concat(before.errs, errs), "; "),
+	})
+}
@@ -32,6 +32,16 @@ func logCountErrTag(err error, msg string, tag string) bool { //nolint:cyclop
 		fmt.Println("Got err", reqerr)
 
 		switch {
+		case reqerr.StatusCode() == http.StatusBadRequest:
+			if isSSECError(err) {
+				fmt.Println("Got 400 error, object may be SSE-C encrypted", msg)
+			}
+
+			if tag != "" {
+				count.Incr("400-error-" + tag)
+			}
+
+			count.Incr("400 error")
 		case reqerr.StatusCode() == http.StatusNotFound:
 			if tag != "" {
 				count.Incr("404-error-" + tag)
@@ -77,3 +87,46 @@ func logCountErrTag(err error, msg string, tag string) bool { //nolint:cyclop
 
 	return is403
 }
+
+// isRetryableErr is true for errors a later try might not get:
+// throttling, timeouts, 5xx and network errors.  4xx like
+// AccessDenied, NoSuchKey, InvalidRequest or a disabled KMS key are
+// final.
+func isRetryableErr(err error) bool {
+	var reqerr awserr.RequestFailure
+
+	if errors.As(err, &reqerr) {
+		switch reqerr.Code() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout", "RequestTimeTooSkewed":
+			return true
+		}
+
+		return reqerr.StatusCode() >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr)
+}
+
+// isSSECError is true for the 400s S3 returns for SSE-C objects when
+// we don't send the customer key: a bare BadRequest from HeadObject,
+// which has no body to say more, or an InvalidRequest saying so.
+func isSSECError(err error) bool {
+	var reqerr awserr.RequestFailure
+
+	if !errors.As(err, &reqerr) || reqerr.StatusCode() != http.StatusBadRequest {
+		return false
+	}
+
+	switch reqerr.Code() {
+	case "BadRequest":
+		return true
+	case "InvalidRequest", "InvalidArgument":
+		m := strings.ToLower(reqerr.Message())
+
+		return strings.Contains(m, "server side encryption") || strings.Contains(m, "customer")
+	}
+
+	return false
+}
@@ -7,6 +7,18 @@ require (
 	github.com/jayalane/go-counter v0.0.0-20241122060713-a345f1a308be
 	github.com/jayalane/go-persist-set v1.0.0
 	github.com/jayalane/go-tinyconfig v0.0.0-20260616204005-02d6097a2747
+	github.com/klauspost/compress v1.20.1
+	github.com/scritchley/orc v0.0.0-20210513144143-06dddf1ad665
+	github.com/xitongsys/parquet-go v1.6.2
 )
 
-require github.com/jmespath/go-jmespath v0.4.0 // indirect
+require (
+	github.com/apache/arrow/go/arrow v0.0.0-20200730104253-651201b0f516 // indirect
+	github.com/apache/thrift v0.14.2 // indirect
+	github.com/golang/protobuf v1.3.3 // indirect
+	github.com/golang/snappy v0.0.3 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.8 // indirect
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0 // indirect
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
+)
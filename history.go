@@ -0,0 +1,579 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historyRunKind     = "run"
+	historyRowKind     = "row"
+	historyCounterKind = "counter"
+	historyEndKind     = "end"
+	historySuffix      = ".jsonl"
+	historyIDLayout    = "20060102T150405Z"
+	historyDirMode     = 0o700
+	diffRunsArgs       = 2
+	historyMaxSameID   = 100 // runs started in the same second
+)
+
+var (
+	errNoRuns        = errors.New("need two complete runs in the history")
+	errDiffRunsArgs  = errors.New("--diffRuns takes no run ids or two")
+	errRunIncomplete = errors.New("run didn't finish")
+	errRunScope      = errors.New("runs have different scopes")
+)
+
+// historyScopeKeys are the config keys that say what a run looked at.
+// Runs that differ in them can't be diffed: whatever only one of them
+// scanned would show as new or resolved.
+var historyScopeKeys = []string{
+	"awsRegion", "checkOrgAccounts", "oneBucket", "oneBucketName",
+	"listFilesMatchingPrefix", "listFilesMatchingSuffix", "listFilesMatchingExclude",
+	"aclInventory", "checkAcl", "checkBucketAccess", "checkBucketEncPosture", "checkBucketPolicy",
+	"checkDuplicates", "checkEtag", "checkJsonl", "checkOwnershipMigration", "checkReplica",
+	"checkSchema", "checkStraySlashes", "countNulls", "dedupeRows", "enforceBucketEncryption",
+	"justListFiles", "migrateObjects", "oneBucketReencrypt", "profileColumns", "reCopyFiles",
+	"repairSlashes", "threeAcl",
+}
+
+// historyReportKeys overrides historyKeyColumns for a report, by the
+// report's config key.  An inventory row is an object; its owner and
+// grants are its state.
+var historyReportKeys = map[string]map[string]bool{
+	"aclInventoryReport": {"bucket": true, "key": true},
+}
+
+// historyKeyColumns are the report columns that say which finding a
+// row is; the rest are its state, and a change in them between runs
+// is a changed finding rather than a new one.  An ACL shape is its
+// owner and grants; its number is only its rank in that run.
+var historyKeyColumns = map[string]bool{
+	"account": true, "bucket": true, "key": true, "source_bucket": true, "source_key": true,
+	"sid": true, "finding": true, "principal": true, "grantee": true, "permission": true,
+	"issue": true, "owner": true, "grants": true, "column": true, "name": true,
+}
+
+// historyRecord is one line of a run's history file.
+type historyRecord struct {
+	Kind    string            `json:"kind"`
+	Run     string            `json:"run,omitempty"`
+	Time    time.Time         `json:"time,omitzero"`
+	Report  string            `json:"report,omitempty"`
+	Bucket  string            `json:"bucket,omitempty"`
+	ID      string            `json:"id,omitempty"`
+	Row     map[string]string `json:"row,omitempty"`
+	Name    string            `json:"name,omitempty"`
+	Count   int64             `json:"count,omitempty"`
+	Scope   map[string]string `json:"scope,omitempty"`
+	Buckets []string          `json:"buckets,omitempty"`
+}
+
+// historyKeysFor returns the key columns for a report file.
+func historyKeysFor(report string) map[string]bool {
+	for k, cols := range historyReportKeys {
+		if theConfig[k].StrVal == report {
+			return cols
+		}
+	}
+
+	return historyKeyColumns
+}
+
+// historyWriter appends a run's findings to its file.
+type historyWriter struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	reports map[string]bool
+}
+
+// createHistoryFile makes a new run file named for the start time,
+// with -01, -02 ... on the end if a run started in the same second
+// already has one.  Returns the run id.
+func createHistoryFile(dir string) (string, *os.File, error) {
+	base := theCtx.progressStart.UTC().Format(historyIDLayout)
+
+	for i := range historyMaxSameID {
+		id := base
+		if i > 0 {
+			id = fmt.Sprintf("%s-%02d", base, i)
+		}
+
+		f, err := os.OpenFile(filepath.Join(dir, id+historySuffix), os.O_WRONLY|os.O_CREATE|os.O_EXCL, summaryFileMode)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+
+		return id, f, err
+	}
+
+	return "", nil, fmt.Errorf("%d runs already started at %s: %w", historyMaxSameID, base, os.ErrExist)
+}
+
+// openHistory starts this run's file in runHistoryDir, named by the
+// start time so the runs sort in order.  The reports recorded are the
+// ones named by the config keys in runHistoryReports.
+func openHistory() {
+	dir := theConfig["runHistoryDir"].StrVal
+	if dir == "" {
+		return
+	}
+
+	err := os.MkdirAll(dir, historyDirMode)
+	if err != nil {
+		log.Println("Can't make run history dir", dir, err)
+
+		return
+	}
+
+	id, f, err := createHistoryFile(dir)
+	if err != nil {
+		log.Println("Can't create run history", dir, err)
+
+		return
+	}
+
+	fn := f.Name()
+
+	h := &historyWriter{f: f, w: bufio.NewWriter(f), reports: make(map[string]bool)}
+	h.enc = json.NewEncoder(h.w)
+
+	for _, k := range strings.Split(theConfig["runHistoryReports"].StrVal, ",") {
+		if k = strings.TrimSpace(k); k != "" && theConfig[k].StrVal != "" {
+			h.reports[theConfig[k].StrVal] = true
+		}
+	}
+
+	theCtx.history = h
+
+	scope := make(map[string]string, len(historyScopeKeys))
+	for _, k := range historyScopeKeys {
+		scope[k] = theConfig[k].StrVal
+	}
+
+	h.add(historyRecord{Kind: historyRunKind, Run: id, Time: theCtx.progressStart, Scope: scope})
+	log.Println("Recording run history", fn)
+}
+
+// add writes one record.
+func (h *historyWriter) add(r historyRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.enc.Encode(r); err != nil {
+		log.Println("Error writing run history", err)
+	}
+}
+
+// historyRowID is the report and the row's key columns.
+func historyRowID(report string, row map[string]string) string {
+	cols := make([]string, 0, len(row))
+	keys := historyKeysFor(report)
+
+	for c := range row {
+		if keys[c] {
+			cols = append(cols, c)
+		}
+	}
+
+	sort.Strings(cols)
+
+	var b strings.Builder
+
+	b.WriteString(report)
+
+	for _, c := range cols {
+		b.WriteString("|" + c + "=" + row[c])
+	}
+
+	return b.String()
+}
+
+// recordHistoryRow records a report row, if its report is one kept in
+// the history.
+func recordHistoryRow(filename string, header []string, row []string) {
+	h := theCtx.history
+	if h == nil || !h.reports[filename] {
+		return
+	}
+
+	m := make(map[string]string, len(header))
+
+	for i, c := range header {
+		if i < len(row) {
+			m[c] = row[i]
+		}
+	}
+
+	bucket := m["bucket"]
+	if bucket == "" {
+		bucket = m["source_bucket"]
+	}
+
+	h.add(historyRecord{Kind: historyRowKind, Report: filename, Bucket: bucket, ID: historyRowID(filename, m), Row: m})
+}
+
+// closeHistory records the per-bucket finding counters and the end
+// record, which marks the run complete and lists the buckets it
+// finished, and closes the file.  Called after the last LogCounters so
+// the counts are final.
+func closeHistory() {
+	h := theCtx.history
+	if h == nil {
+		return
+	}
+
+	sum := buildRunSummary()
+
+	for _, f := range sum.Findings {
+		if f.Bucket != "" {
+			h.add(historyRecord{Kind: historyCounterKind, Bucket: f.Bucket, Name: f.Name, Count: f.Count})
+		}
+	}
+
+	var done []string
+
+	for _, b := range sum.Buckets {
+		if b.State == stateDone {
+			done = append(done, b.Bucket)
+		}
+	}
+
+	h.add(historyRecord{Kind: historyEndKind, Time: sum.End, Buckets: done})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	err := h.w.Flush()
+	if err == nil {
+		err = h.f.Close()
+	}
+
+	if err != nil {
+		log.Println("Error closing run history", err)
+	}
+}
+
+// historyRun is a run read back from its file.
+type historyRun struct {
+	id       string
+	scope    map[string]string
+	complete bool
+	buckets  map[string]bool // finished
+	rows     map[string]historyRecord
+	counters map[string]map[string]int64 // bucket to counter to count
+}
+
+// readHistoryRun loads a run by id.
+func readHistoryRun(dir string, id string) (*historyRun, error) {
+	f, err := os.Open(filepath.Join(dir, id+historySuffix)) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	run := &historyRun{
+		id: id, buckets: make(map[string]bool),
+		rows: make(map[string]historyRecord), counters: make(map[string]map[string]int64),
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, scannerBufSize), scannerBufSize)
+
+	for sc.Scan() {
+		var r historyRecord
+
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+
+		switch r.Kind {
+		case historyRunKind:
+			run.scope = r.Scope
+		case historyEndKind:
+			run.complete = true
+
+			for _, b := range r.Buckets {
+				run.buckets[b] = true
+			}
+		case historyRowKind:
+			run.rows[r.ID] = r
+		case historyCounterKind:
+			if run.counters[r.Bucket] == nil {
+				run.counters[r.Bucket] = make(map[string]int64)
+			}
+
+			run.counters[r.Bucket][r.Name] = r.Count
+		}
+	}
+
+	return run, sc.Err()
+}
+
+// listHistoryRuns returns the run ids, oldest first.
+func listHistoryRuns(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+historySuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(f), historySuffix))
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// rowState is the row's non key columns, for printing a change.
+func rowState(report string, row map[string]string) string {
+	cols := make([]string, 0, len(row))
+	keys := historyKeysFor(report)
+
+	for c := range row {
+		if !keys[c] {
+			cols = append(cols, c)
+		}
+	}
+
+	sort.Strings(cols)
+
+	parts := make([]string, 0, len(cols))
+	for _, c := range cols {
+		parts = append(parts, c+"="+row[c])
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// checkDiffable is an error unless both runs finished and had the
+// same scope.
+func checkDiffable(a *historyRun, b *historyRun) error {
+	for _, r := range []*historyRun{a, b} {
+		if !r.complete {
+			return fmt.Errorf("%s: %w", r.id, errRunIncomplete)
+		}
+	}
+
+	var diff []string
+
+	for _, k := range historyScopeKeys {
+		if a.scope[k] != b.scope[k] {
+			diff = append(diff, fmt.Sprintf("%s %q -> %q", k, a.scope[k], b.scope[k]))
+		}
+	}
+
+	if len(diff) > 0 {
+		return fmt.Errorf("%s, %s: %w: %s", a.id, b.id, errRunScope, strings.Join(diff, ", "))
+	}
+
+	return nil
+}
+
+// diffHistoryRuns prints the findings new in b, resolved since a and
+// changed between them, then the buckets that changed and how.  Only
+// buckets both runs finished are compared; the others are listed.
+func diffHistoryRuns(a *historyRun, b *historyRun) { //nolint:cyclop,gocognit
+	changed := make(map[string][]string) // bucket to what changed
+	both := func(bucket string) bool { return a.buckets[bucket] && b.buckets[bucket] }
+
+	var skipped []string
+
+	for bucket := range a.buckets {
+		if !b.buckets[bucket] {
+			skipped = append(skipped, bucket)
+		}
+	}
+
+	for bucket := range b.buckets {
+		if !a.buckets[bucket] {
+			skipped = append(skipped, bucket)
+		}
+	}
+
+	if len(skipped) > 0 {
+		sort.Strings(skipped)
+		fmt.Println("WARNING: not comparing buckets only one run finished:", strings.Join(skipped, " "))
+	}
+
+	ids := make([]string, 0, len(a.rows)+len(b.rows))
+	for id := range a.rows {
+		ids = append(ids, id)
+	}
+
+	for id := range b.rows {
+		if _, ok := a.rows[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	var news, resolved, changes int
+
+	for _, id := range ids {
+		ra, inA := a.rows[id]
+		rb, inB := b.rows[id]
+
+		if (inA && !both(ra.Bucket)) || (inB && !both(rb.Bucket)) {
+			continue
+		}
+
+		switch {
+		case !inA:
+			news++
+
+			fmt.Println("NEW", id, rowState(rb.Report, rb.Row))
+			changed[rb.Bucket] = append(changed[rb.Bucket], "new "+rb.Report)
+		case !inB:
+			resolved++
+
+			fmt.Println("RESOLVED", id, rowState(ra.Report, ra.Row))
+			changed[ra.Bucket] = append(changed[ra.Bucket], "resolved "+ra.Report)
+		case rowState(ra.Report, ra.Row) != rowState(rb.Report, rb.Row):
+			changes++
+
+			fmt.Println("CHANGED", id, rowState(ra.Report, ra.Row), "->", rowState(rb.Report, rb.Row))
+			changed[rb.Bucket] = append(changed[rb.Bucket], "changed "+rb.Report)
+		}
+	}
+
+	buckets := make(map[string]bool)
+	for bucket := range a.counters {
+		buckets[bucket] = true
+	}
+
+	for bucket := range b.counters {
+		buckets[bucket] = true
+	}
+
+	for bucket := range buckets {
+		if !both(bucket) {
+			continue
+		}
+
+		names := make(map[string]bool)
+		for n := range a.counters[bucket] {
+			names[n] = true
+		}
+
+		for n := range b.counters[bucket] {
+			names[n] = true
+		}
+
+		for n := range names {
+			if ca, cb := a.counters[bucket][n], b.counters[bucket][n]; ca != cb {
+				changed[bucket] = append(changed[bucket], fmt.Sprintf("%s %d -> %d", n, ca, cb))
+			}
+		}
+	}
+
+	list := make([]string, 0, len(changed))
+	for bucket := range changed {
+		list = append(list, bucket)
+	}
+
+	sort.Strings(list)
+
+	for _, bucket := range list {
+		sort.Strings(changed[bucket])
+		fmt.Println("BUCKET", bucket, strings.Join(changed[bucket], ", "))
+	}
+
+	fmt.Println("Diff", a.id, "->", b.id, news, "new,", resolved, "resolved,", changes, "changed findings,",
+		len(list), "changed buckets")
+}
+
+// lastCompleteRuns returns the last two runs that finished, skipping
+// ones that were stopped part way.
+func lastCompleteRuns(dir string, ids []string) (*historyRun, *historyRun, error) {
+	var runs []*historyRun
+
+	for i := len(ids) - 1; i >= 0 && len(runs) < diffRunsArgs; i-- {
+		r, err := readHistoryRun(dir, ids[i])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !r.complete {
+			fmt.Println("Skipping incomplete run", r.id)
+
+			continue
+		}
+
+		runs = append(runs, r)
+	}
+
+	if len(runs) < diffRunsArgs {
+		return nil, nil, errNoRuns
+	}
+
+	return runs[1], runs[0], nil
+}
+
+// runHistoryCommand handles --listRuns and --diffRuns [old new], the
+// latter defaulting to the last two complete runs.  Runs that didn't
+// finish or had different scopes aren't diffed.  Returns false if args isn't
+// one of them.
+func runHistoryCommand(args []string) (bool, error) {
+	if len(args) == 0 || (args[0] != "--listRuns" && args[0] != "--diffRuns") {
+		return false, nil
+	}
+
+	dir := theConfig["runHistoryDir"].StrVal
+
+	ids, err := listHistoryRuns(dir)
+	if err != nil {
+		return true, err
+	}
+
+	if args[0] == "--listRuns" {
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+
+		return true, nil
+	}
+
+	var a, b *historyRun
+
+	switch pick := args[1:]; len(pick) {
+	case diffRunsArgs:
+		if a, err = readHistoryRun(dir, pick[0]); err != nil {
+			return true, err
+		}
+
+		if b, err = readHistoryRun(dir, pick[1]); err != nil {
+			return true, err
+		}
+	case 0:
+		if a, b, err = lastCompleteRuns(dir, ids); err != nil {
+			return true, err
+		}
+	default:
+		return true, errDiffRunsArgs
+	}
+
+	if err := checkDiffable(a, b); err != nil {
+		return true, err
+	}
+
+	diffHistoryRuns(a, b)
+
+	return true, nil
+}
@@ -0,0 +1,270 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	jsonString = "string"
+	jsonNumber = "number"
+	jsonBool   = "bool"
+	jsonObject = "object"
+	jsonArray  = "array"
+	jsonNull   = "null"
+)
+
+var errJSONTrailing = errors.New("trailing data after JSON value")
+
+// jsonPath is one of jsonlPaths: dotted keys with [n] array indexes,
+// and an optional ":type" the value must have.
+type jsonPath struct {
+	text  string
+	steps []interface{} // string key or int index
+	want  string
+}
+
+// parseJSONPath parses "a.b[2].c:string".
+func parseJSONPath(s string) (jsonPath, error) {
+	p := jsonPath{text: s}
+
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		p.text, p.want = s[:i], s[i+1:]
+
+		switch p.want {
+		case jsonString, jsonNumber, jsonBool, jsonObject, jsonArray:
+		default:
+			return p, fmt.Errorf("unknown type %s in %s", p.want, s) //nolint:err113
+		}
+	}
+
+	for _, part := range strings.Split(p.text, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key != "" {
+			p.steps = append(p.steps, key)
+		}
+
+		for rest != "" {
+			idx, after, ok := strings.Cut(rest, "]")
+			if !ok {
+				return p, fmt.Errorf("unclosed [ in %s", s) //nolint:err113
+			}
+
+			n, err := strconv.Atoi(idx)
+			if err != nil {
+				return p, fmt.Errorf("bad index %s in %s", idx, s) //nolint:err113
+			}
+
+			p.steps = append(p.steps, n)
+			rest = strings.TrimPrefix(after, "[")
+		}
+	}
+
+	if len(p.steps) == 0 {
+		return p, fmt.Errorf("empty path %s", s) //nolint:err113
+	}
+
+	return p, nil
+}
+
+// parseJSONPaths parses the comma separated jsonlPaths.
+func parseJSONPaths(s string) ([]jsonPath, error) {
+	var res []jsonPath
+
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		p, err := parseJSONPath(f)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, p)
+	}
+
+	return res, nil
+}
+
+// lookup follows the path; false if any step is missing.
+func (p jsonPath) lookup(v interface{}) (interface{}, bool) {
+	for _, step := range p.steps {
+		switch s := step.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+
+			if v, ok = m[s]; !ok {
+				return nil, false
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || s >= len(a) {
+				return nil, false
+			}
+
+			v = a[s]
+		}
+	}
+
+	return v, true
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return jsonNull
+	case string:
+		return jsonString
+	case json.Number:
+		return jsonNumber
+	case bool:
+		return jsonBool
+	case map[string]interface{}:
+		return jsonObject
+	default:
+		return jsonArray
+	}
+}
+
+// countJSONL counts one path result under the usual total, per
+// bucket and per file names.
+func countJSONL(what string, p jsonPath, bucket string, baseName string) {
+	count.Incr("jsonl-" + what)
+	count.Incr("jsonl-" + what + "-" + bucket)
+	count.Incr("jsonl-" + what + "-" + baseName)
+	count.Incr("jsonl-" + what + "-" + p.text)
+}
+
+// streamAndCheckJSONL streams a newline delimited JSON object and, for
+// each of the paths, counts rows where it is missing, null, an empty
+// string or not the wanted type.  Lines that aren't JSON are counted,
+// and the first jsonlPrintMalformed of them in each file printed with
+// their line number.
+func streamAndCheckJSONL(bucket string, key string, paths []jsonPath, sess *session.Session) { //nolint:cyclop
+	if !keyHasSuffix(key, theConfig["jsonlKeySuffixes"].StrVal) {
+		count.Incr("jsonl-skip-key")
+
+		return
+	}
+
+	count.Incr("aws-get-object")
+
+	resp, err := s3.New(sess).GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		logCountErrTag(err, "GetObject failed "+bucket+"/"+key, bucket)
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	body, done, err := decodedBody(bucket, key, resp)
+	if err != nil {
+		log.Println("Error decompressing object", bucket, key, err)
+		count.Incr("jsonl-decompress-error")
+
+		return
+	}
+
+	defer done()
+
+	br := bufio.NewReaderSize(body, scannerBufSize)
+	baseName := path.Base(key)
+	lineNum := 0
+	malformed := 0
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Println("Error scanning object", bucket, key, err)
+			count.Incr("jsonl-scan-error")
+
+			return
+		}
+
+		lineNum++
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			count.Incr("jsonl-blank-line")
+
+			continue
+		}
+
+		count.Incr("row")
+		count.Incr("row-" + bucket)
+		count.Incr("row-" + baseName)
+
+		var v interface{}
+
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+
+		derr := dec.Decode(&v)
+		if derr == nil && dec.More() {
+			derr = errJSONTrailing
+		}
+
+		if derr != nil {
+			malformed++
+
+			count.Incr("jsonl-malformed-line")
+			count.Incr("jsonl-malformed-line-" + bucket)
+			count.Incr("jsonl-malformed-line-" + baseName)
+
+			if malformed <= theConfig["jsonlPrintMalformed"].IntVal {
+				fmt.Printf("FILE=%s LINE=%d MALFORMED=%v\n", baseName, lineNum, derr)
+			}
+
+			continue
+		}
+
+		for _, p := range paths {
+			val, ok := p.lookup(v)
+
+			switch {
+			case !ok:
+				countJSONL("missing", p, bucket, baseName)
+			case val == nil:
+				countJSONL("null", p, bucket, baseName)
+			case val == "":
+				countJSONL("empty-string", p, bucket, baseName)
+			case p.want != "" && jsonType(val) != p.want:
+				countJSONL("type-mismatch", p, bucket, baseName)
+			default:
+				countJSONL("present", p, bucket, baseName)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	fmt.Println("Scanned", lineNum, "JSON lines,", malformed, "malformed, from", bucket, key)
+	count.IncrDelta("jsonl-lines", int64(lineNum))
+}
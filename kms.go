@@ -0,0 +1,224 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	kmsKeyStateUnknown = "Unknown"
+	arnRegionField     = 3
+	arnResourceField   = 5
+)
+
+// kmsKeyInfo is what we care about for a KMS key.  arn is the
+// canonical key ARN (never an alias) when DescribeKey worked.
+type kmsKeyInfo struct {
+	arn    string
+	acctID string
+	state  string
+}
+
+// usable is true if the key can still decrypt.
+func (k *kmsKeyInfo) usable() bool {
+	return k.state == kms.KeyStateEnabled || k.state == kmsKeyStateUnknown
+}
+
+// regionFromARN returns the region field of an ARN or "".
+func regionFromARN(s string) string {
+	if !strings.HasPrefix(s, "arn:") {
+		return ""
+	}
+
+	f := strings.SplitN(s, ":", arnFields)
+	if len(f) < arnFields {
+		return ""
+	}
+
+	return f[arnRegionField]
+}
+
+// isAliasRef is true for "alias/x" and alias ARNs.
+func isAliasRef(ref string) bool {
+	if strings.HasPrefix(ref, "alias/") {
+		return true
+	}
+
+	f := strings.SplitN(ref, ":", arnFields)
+
+	return len(f) == arnFields && strings.HasPrefix(f[arnResourceField], "alias/")
+}
+
+// kmsCacheKey scopes aliases and bare key IDs to the account and
+// region they were seen in; ARNs are already global.
+func kmsCacheKey(ref string, acctID string, region string) string {
+	if strings.HasPrefix(ref, "arn:") {
+		return ref
+	}
+
+	return acctID + "/" + region + "/" + ref
+}
+
+// kmsSvcFor returns a KMS client in the key's region if the ref
+// names one, else in the session's region.
+func kmsSvcFor(ref string, sess *session.Session) *kms.KMS {
+	if r := regionFromARN(ref); r != "" && r != aws.StringValue(sess.Config.Region) {
+		return kms.New(sess, aws.NewConfig().WithRegion(r))
+	}
+
+	return kms.New(sess)
+}
+
+// loadKMSAliases fills the alias cache for an account/region from
+// ListAliases, once.
+func loadKMSAliases(acctID string, region string, sess *session.Session) {
+	scope := acctID + "/" + region
+
+	theCtx.kmsRW.RLock()
+	_, done := theCtx.kmsAliasScopes[scope]
+	theCtx.kmsRW.RUnlock()
+
+	if done {
+		return
+	}
+
+	aliases := make(map[string]string)
+
+	count.Incr("aws-kms-list-aliases")
+
+	err := kms.New(sess).ListAliasesPages(&kms.ListAliasesInput{},
+		func(out *kms.ListAliasesOutput, _ bool) bool {
+			for _, a := range out.Aliases {
+				if a.TargetKeyId == nil {
+					continue // AWS managed alias that was never used
+				}
+
+				aliases[kmsCacheKey(aws.StringValue(a.AliasName), acctID, region)] = *a.TargetKeyId
+				aliases[aws.StringValue(a.AliasArn)] = *a.TargetKeyId
+			}
+
+			return true
+		})
+	if err != nil {
+		logCountErr(err, "ListAliases failed "+scope)
+	}
+
+	theCtx.kmsRW.Lock()
+	defer theCtx.kmsRW.Unlock()
+
+	theCtx.kmsAliasScopes[scope] = true
+
+	for k, v := range aliases {
+		theCtx.kmsAliases[k] = v
+	}
+}
+
+// resolveKMSKey turns an alias, key ID or ARN into the key's info,
+// caching the answer.  If the key can't be described (e.g. no
+// permission on a cross account key) the info has state Unknown
+// and whatever the ref itself says about the ARN and account.
+func resolveKMSKey(ref string, acctID string, region string, sess *session.Session) *kmsKeyInfo {
+	ck := kmsCacheKey(ref, acctID, region)
+
+	theCtx.kmsRW.RLock()
+	info, ok := theCtx.kmsKeys[ck]
+	theCtx.kmsRW.RUnlock()
+
+	if ok {
+		count.Incr("kms-cache-hit")
+
+		return info
+	}
+
+	lookup := ref
+
+	if isAliasRef(ref) {
+		loadKMSAliases(acctID, region, sess)
+
+		theCtx.kmsRW.RLock()
+		target, found := theCtx.kmsAliases[ck]
+		theCtx.kmsRW.RUnlock()
+
+		if found {
+			lookup = target
+		}
+	}
+
+	info = &kmsKeyInfo{arn: ref, acctID: acctFromARN(ref), state: kmsKeyStateUnknown}
+	if info.acctID == "" {
+		info.acctID = acctID
+	}
+
+	count.Incr("aws-kms-describe-key")
+
+	out, err := kmsSvcFor(ref, sess).DescribeKey(&kms.DescribeKeyInput{KeyId: aws.String(lookup)})
+	if err != nil {
+		logCountErr(err, "DescribeKey failed "+ref)
+		count.Incr("kms-describe-key-failed")
+	} else if out.KeyMetadata != nil {
+		info.arn = aws.StringValue(out.KeyMetadata.Arn)
+		info.acctID = aws.StringValue(out.KeyMetadata.AWSAccountId)
+		info.state = aws.StringValue(out.KeyMetadata.KeyState)
+	}
+
+	log.Println("Resolved kms key", ref, info.arn, info.acctID, info.state)
+
+	theCtx.kmsRW.Lock()
+	theCtx.kmsKeys[ck] = info
+	theCtx.kmsRW.Unlock()
+
+	return info
+}
+
+// sameKMSKey compares two key refs by their canonical ARNs.  If
+// neither could be described, fall back to the key ID at the end of
+// the ARN.
+func sameKMSKey(a *kmsKeyInfo, b *kmsKeyInfo) bool {
+	if a.arn == b.arn {
+		return true
+	}
+
+	if a.state != kmsKeyStateUnknown && b.state != kmsKeyStateUnknown {
+		return false
+	}
+
+	return kmsKeyIDOf(a.arn) != "" && kmsKeyIDOf(a.arn) == kmsKeyIDOf(b.arn)
+}
+
+// kmsKeyIDOf returns the key ID of a key ARN or bare key ID; "" for aliases.
+func kmsKeyIDOf(ref string) string {
+	if isAliasRef(ref) {
+		return ""
+	}
+
+	if i := strings.LastIndex(ref, "key/"); i >= 0 {
+		return ref[i+len("key/"):]
+	}
+
+	return ref
+}
+
+// kmsAcctAllowed says if a key owned by keyAcct is ok for a bucket
+// in bucketAcct: kmsKeyAllowedAccounts if set, otherwise only the
+// bucket's own account.
+func kmsAcctAllowed(keyAcct string, bucketAcct string) bool {
+	allowed := theConfig["kmsKeyAllowedAccounts"].StrVal
+	if allowed == "" {
+		return keyAcct == bucketAcct
+	}
+
+	for _, a := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(a) == keyAcct {
+			return true
+		}
+	}
+
+	return false
+}
@@ -65,6 +65,112 @@ numAccountHandlers = 1
 numBucketHandlers = 10
 numObjectHandlers = 1000
 profListen = localhost:6060
+checkBucketEncPosture = false
+bucketPostureReport = bucketEncPosture.csv
+enforceBucketEncryption = false
+setToDangerToEnforceEncryption = no
+enforceKmsKeyDefault =
+enforceKmsKeyFile =
+enforceReport = bucketEncRemediation.csv
+kmsKeyAllowedAccounts =
+migrateObjects = false
+migrateTargetAcct =
+migrateTargetRegion =
+migrateTargetSSE = aws:kms
+migrateTargetKmsKey =
+migrateSourcePrefix =
+migrateTargetPrefix =
+migrateDeleteSource = false
+migrateMaxRetries = 5
+setToDangerToMigrate = no
+migrateReport = objectMigration.csv
+encTypeReport = unusualEncryption.csv
+checkBucketAccess = false
+bucketAccessReport = bucketAccessPosture.csv
+checkOwnershipMigration = false
+setToDangerToEnforceOwnership = no
+ownershipAllowDroppedGrants = false
+ownershipReport = ownershipCompat.csv
+checkBucketPolicy = false
+policyTrustedAccounts =
+bucketPolicyReport = bucketPolicyFindings.csv
+threeAcl = false
+threeAcctAclReader =
+# desiredAclFile lines: <bucket[/prefix] or *> <grantee> <PERM,PERM> is the grantee's
+# exact permissions (missing ones added, others removed), <scope> !<grantee>
+# removes all of the grantee's grants; fixed only with readOnly and
+# setToDangerToForceACL set to danger, otherwise report only
+desiredAclFile =
+desiredAclReport = aclDiff.csv
+aclInventory = false
+aclInventoryPerObject = false
+aclInventoryReport = aclInventory.csv
+aclShapesReport = aclShapes.csv
+aclShapeSamples = 5
+decompress = true
+nullCheckDelimiter = tab
+slashCheckDelimiter = comma
+csvQuote =
+csvEscape = none
+csvLineTerminator = lf
+maxRecordBytes = 1073741824
+headerRulesFile =
+profileColumns = false
+profileDelimiter = tab
+profileHasHeader = true
+profileKeySuffixes =
+profileTopK = 10
+profileBadSamples = 5
+profileFileReport = columnProfileFiles.csv
+profileBucketReport = columnProfileBuckets.csv
+checkSchema = false
+schemaFile =
+schemaDelimiter = tab
+schemaHasHeader = true
+schemaKeySuffixes =
+schemaMaxViolationsPerFile = 1000
+schemaReport = schemaViolations.csv
+repairSlashes = false
+slashFix = escape
+slashReplaceWith = _
+repairTargetSuffix = .repaired
+repairBackupPrefix = slash-repair-backup/
+setToDangerToRepair = no
+repairReport = slashRepair.csv
+rangeReadChunkBytes = 1048576
+checkJsonl = false
+jsonlPaths =
+jsonlKeySuffixes =
+jsonlPrintMalformed = 10
+checkDuplicates = false
+dedupeScope = bucket
+dedupeRows = false
+dedupeKeyColumn =
+dedupeKeyIndex = -1
+dedupeDelimiter = tab
+dedupeApprox = false
+dedupeBloomBits = 268435456
+dedupeMaxScopes = 16
+dedupeFileBloomBits = 8388608
+dedupeReport = duplicates.csv
+rangeScanMinBytes = 1073741824
+rangeScanPartBytes = 268435456
+rangeScanOverlapBytes = 1048576
+rangeScanConcurrency = 16
+nullCheckSelect = false
+nullCheckSelectVerify = false
+slashPrintRows = false
+slashSampleRows = 20
+slashSampleTarget = slashSamples.csv
+setToDangerToWriteSamples = no
+metricsPrefix = aws_learn
+metricsMaxSeries = 10000
+progressInterval = 60
+progressCloudWatch = true
+summaryJson = runSummary.json
+summaryMarkdown = runSummary.md
+runHistoryDir = runHistory
+runHistoryReports = bucketPostureReport,encTypeReport,bucketAccessReport,ownershipReport,bucketPolicyReport,desiredAclReport,aclShapesReport
 # comments
 `
 )
@@ -84,6 +190,7 @@ type objectChanItem struct {
 	object string
 	region string
 	wg     *sync.WaitGroup
+	tries  int // retries so far
 }
 
 // info about a bucket to check.
@@ -94,19 +201,59 @@ type bucketChanItem struct {
 
 // context holds the global state.
 type context struct {
-	doneObjects *set.DB
-	lastObj     int64
-	filter      *[]string
-	bucketChan  chan bucketChanItem
-	objectChan  chan objectChanItem
-	accountChan chan string
-	credsRW     sync.RWMutex
-	creds       map[string]*credentials.Credentials
-	wg          *sync.WaitGroup
-	canonIDMap  map[string]string
-	canonRW     sync.RWMutex
-	keyIDMap    map[string]string
-	keyRW       sync.RWMutex
+	doneObjects    *set.DB
+	lastObj        int64
+	filter         *[]string
+	bucketChan     chan bucketChanItem
+	objectChan     chan objectChanItem
+	accountChan    chan string
+	credsRW        sync.RWMutex
+	creds          map[string]*credentials.Credentials
+	wg             *sync.WaitGroup
+	canonIDMap     map[string]string
+	canonRW        sync.RWMutex
+	keyIDMap       map[string]string
+	keyRW          sync.RWMutex
+	reports        map[string]*reportWriter
+	reportsRW      sync.Mutex
+	selfAcct       string
+	selfAcctOnce   sync.Once
+	keyTargets     map[string]string
+	kmsKeys        map[string]*kmsKeyInfo
+	kmsAliases     map[string]string
+	kmsAliasScopes map[string]bool
+	kmsRW          sync.RWMutex
+	acctBlocks     map[string]publicBlock
+	acctBlockRW    sync.RWMutex
+	ownership      map[string]*ownershipTally
+	ownershipRW    sync.RWMutex
+	orgAccts       map[string]string // id to name, filled before accounts are queued
+	desiredACL     []aclRule
+	aclShapes      map[string]map[string]*aclShape
+	aclShapesRW    sync.Mutex
+	headerRules    []headerRule
+	profiles       map[string]*tableProfile
+	profilesRW     sync.Mutex
+	schema         []schemaColumn
+	prefixHeaders  map[string]prefixHeader
+	schemaRW       sync.Mutex
+	jsonPaths      []jsonPath
+	dedupeObjs     map[string]map[dedupeGroup][]dedupeObj
+	dedupeRows     map[string]map[string]*rowScope
+	dedupeLive     int   // prefix sets held, over all buckets
+	dedupeTick     int64 // for the prefix sets' last use
+	dedupeRW       sync.Mutex
+	rangeSem       chan struct{} // range scan slots, shared by all objects
+	metrics        map[metricSeries]int64
+	metricBuckets  map[string]bool
+	metricNames    map[string]metricSeries // counter name to its series
+	metricsRW      sync.Mutex
+	progress       map[string]*bucketProgress
+	progressRW     sync.Mutex
+	progressStart  time.Time
+	history        *historyWriter
+	sampleSess     *session.Session // for an s3:// slashSampleTarget
+	sampleSessOnce sync.Once
 }
 
 var theCtx context
@@ -339,9 +486,17 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 
 			if headErr != nil {
 				logCountErrTag(headErr, "bucket/object"+k+"/"+b, b)
+
+				if isSSECError(headErr) {
+					reportEncType(b, k, encTypeSSEC, "", "HeadObject 400, likely SSE-C")
+				}
 			} else {
+				progressObject(b, objectSize(head))
+
 				etag = head.ETag
 
+				reportEncType(b, k, objectEncType(*head), aws.StringValue(head.SSEKMSKeyId), "seen in HeadObject")
+
 				if head.ContentLength != nil {
 					count.IncrDelta("object-length", *head.ContentLength)
 					count.IncrDelta("object-length-"+b, *head.ContentLength)
@@ -411,6 +566,7 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 				streamAndCountNulls(b, k,
 					theConfig["nullCheckFieldIndex"].IntVal,
 					theConfig["nullCheckFieldName"].StrVal,
+					head,
 					sess)
 				kb.wg.Done()
 				theCtx.wg.Done()
@@ -418,11 +574,52 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 				continue
 			}
 
+			if theConfig["checkJsonl"].BoolVal {
+				count.Incr("handle-jsonl")
+				count.Incr("handle-jsonl-" + b)
+				streamAndCheckJSONL(b, k, theCtx.jsonPaths, sess)
+				kb.wg.Done()
+				theCtx.wg.Done()
+
+				continue
+			}
+
+			if theConfig["profileColumns"].BoolVal {
+				count.Incr("handle-profile")
+				count.Incr("handle-profile-" + b)
+				profileObject(b, k, sess)
+				kb.wg.Done()
+				theCtx.wg.Done()
+
+				continue
+			}
+
+			if theConfig["checkSchema"].BoolVal {
+				count.Incr("handle-schema")
+				count.Incr("handle-schema-" + b)
+				validateObjectSchema(b, k, sess)
+				kb.wg.Done()
+				theCtx.wg.Done()
+
+				continue
+			}
+
+			if theConfig["repairSlashes"].BoolVal {
+				count.Incr("handle-slash-repair")
+				count.Incr("handle-slash-repair-" + b)
+				repairSlashesInObject(b, k, sess)
+				kb.wg.Done()
+				theCtx.wg.Done()
+
+				continue
+			}
+
 			if theConfig["checkStraySlashes"].BoolVal {
 				count.Incr("handle-slash-check")
 				count.Incr("handle-slash-check-" + b)
 				streamAndCheckSlashes(b, k,
 					theConfig["slashCheckHasHeader"].BoolVal,
+					head,
 					sess)
 				kb.wg.Done()
 				theCtx.wg.Done()
@@ -430,6 +627,16 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 				continue
 			}
 
+			if theConfig["aclInventory"].BoolVal {
+				count.Incr("handle-acl-inventory")
+				count.Incr("handle-acl-inventory-" + b)
+				inventoryACL(b, k, sess)
+				kb.wg.Done()
+				theCtx.wg.Done()
+
+				continue
+			}
+
 			// not just list files
 			if theConfig["checkAcl"].BoolVal {
 				count.Incr("handle-acl")
@@ -451,6 +658,16 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 				continue
 			}
 
+			if theConfig["checkOwnershipMigration"].BoolVal {
+				count.Incr("handle-ownership")
+				count.Incr("handle-ownership-" + b)
+				checkObjectOwnership(b, k, head, sess)
+				kb.wg.Done()
+				theCtx.wg.Done()
+
+				continue
+			}
+
 			// Remaining modes require HeadObject data
 			if headErr != nil {
 				kb.wg.Done()
@@ -459,6 +676,48 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 				continue
 			}
 
+			if theConfig["checkDuplicates"].BoolVal {
+				count.Incr("handle-dedupe")
+				count.Incr("handle-dedupe-" + b)
+				addDedupeObject(b, k, *head)
+
+				if theConfig["dedupeRows"].BoolVal {
+					dedupeRowsInObject(b, k, sess)
+				}
+
+				kb.wg.Done()
+				theCtx.wg.Done()
+
+				continue
+			}
+
+			if theConfig["migrateObjects"].BoolVal {
+				count.Incr("handle-migrate")
+				count.Incr("handle-migrate-" + b)
+
+				switch {
+				case !migrateObject(kb, *head, tooBig, sess):
+				case kb.tries >= theConfig["migrateMaxRetries"].IntVal:
+					fmt.Println("Giving up migrating after", kb.tries, "retries", b, k)
+					count.Incr("migrate-retries-exhausted")
+				default:
+					count.Incr("retry-migrate-object")
+
+					kb.wg.Add(1)     // Done in handleObject
+					theCtx.wg.Add(1) // Done in handleObject
+
+					retry := kb
+					retry.tries++
+
+					time.AfterFunc(migrateBackoff(kb.tries), func() { theCtx.objectChan <- retry })
+				}
+
+				kb.wg.Done()
+				theCtx.wg.Done()
+
+				continue
+			}
+
 			// Dedup check (for reencrypt/recopy retries)
 			sb := keyName(*aws.String(b), *aws.String(k))
 			if theCtx.doneObjects.InSet(sb) {
@@ -521,7 +780,7 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 				}
 
 				if !tooBig {
-					retry := reencryptObject(b, k, false, sess) // false is don't care about key
+					retry := reencryptObject(b, k, false, *head, sess) // false is don't care about key
 
 					if retry {
 						count.Incr("retry-copy-object")
@@ -535,10 +794,14 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 				}
 			case theConfig["oneBucketReencrypt"].BoolVal:
 				// we will be reencrypting
-				if !isObjectEncOk(b, *head) { //nolint:nestif
+				if ok, fixable := isObjectEncOk(b, k, kb.acctID, *head, sess); !ok { //nolint:nestif
 					count.Incr("encrypt-bad")
 					count.Incr("encrypt-bad-" + b)
 
+					if !fixable { // reported, leave it alone
+						break
+					}
+
 					if theConfig["readOnly"].StrVal != danger {
 						break
 					}
@@ -548,7 +811,7 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 					}
 
 					if !tooBig {
-						retry := reencryptObject(b, k, true, sess) // true is must have KMS ID
+						retry := reencryptObject(b, k, true, *head, sess) // true is must have KMS ID
 						if retry {
 							count.Incr("retry-object")
 							count.Incr("retry-object-" + b)
@@ -560,16 +823,18 @@ func handleObject() { //nolint:gocognit, cyclop, gocyclo, maintidx
 					count.Incr("encrypt-good-" + b)
 				}
 			default:
-				if !isObjectEncOk(b, *head) {
+				if ok, _ := isObjectEncOk(b, k, kb.acctID, *head, sess); !ok {
 					count.Incr("unencrypted")
 					count.Incr("unencrypted-" + b)
 
 					if rand.Float64() < (1.0 / (float64(count.ReadSync("unencrypted")))) { //nolint:gosec
 						switch {
+						case head.SSECustomerAlgorithm != nil:
+							fmt.Println("ERROR: SSE-C, can't check key", b, k)
 						case head.ServerSideEncryption == nil:
 							fmt.Println("ERROR: no encryption", b, k)
-						case *head.ServerSideEncryption == "aws:kms":
-							fmt.Println("ERROR: ", b, k, *head.ServerSideEncryption, *head.SSEKMSKeyId)
+						case *head.ServerSideEncryption == "aws:kms", *head.ServerSideEncryption == "aws:kms:dsse":
+							fmt.Println("ERROR: ", b, k, *head.ServerSideEncryption, aws.StringValue(head.SSEKMSKeyId))
 						default:
 							fmt.Println("ERROR: ", b, k, *head.ServerSideEncryption)
 						}
@@ -609,6 +874,7 @@ func handleBucket() { //nolint:cyclop,gocognit
 		case b := <-theCtx.bucketChan:
 			atomic.StoreInt64(&theCtx.lastObj, makeTimestamp())
 			log.Println("Got a bucket", b.bucket)
+			progressStart(b.bucket)
 
 			if b.acctID == "0" {
 				sess = initSess
@@ -616,6 +882,7 @@ func handleBucket() { //nolint:cyclop,gocognit
 				sess = getSessForAcct(b.acctID)
 				if sess == nil {
 					log.Println("Can't log into AWS!")
+					progressDone(b.bucket)
 					theCtx.wg.Done()
 
 					continue
@@ -637,6 +904,46 @@ func handleBucket() { //nolint:cyclop,gocognit
 				sess, err = session.NewSession(sess.Config.Copy(&aws.Config{Region: aws.String(region)}))
 				if err != nil {
 					log.Println("Can't create session for region", region, b.bucket, err)
+					progressDone(b.bucket)
+					theCtx.wg.Done()
+
+					continue
+				}
+			}
+
+			if theConfig["checkBucketEncPosture"].BoolVal {
+				count.Incr("handle-bucket-enc-posture")
+				checkBucketEncPosture(b.acctID, b.bucket, region, sess)
+				progressDone(b.bucket)
+				theCtx.wg.Done()
+
+				continue
+			}
+
+			if theConfig["checkBucketAccess"].BoolVal {
+				count.Incr("handle-bucket-access")
+				checkBucketAccess(b.acctID, b.bucket, region, sess)
+				progressDone(b.bucket)
+				theCtx.wg.Done()
+
+				continue
+			}
+
+			if theConfig["checkBucketPolicy"].BoolVal {
+				count.Incr("handle-bucket-policy")
+				checkBucketPolicy(b.acctID, b.bucket, sess)
+				progressDone(b.bucket)
+				theCtx.wg.Done()
+
+				continue
+			}
+
+			if theConfig["enforceBucketEncryption"].BoolVal {
+				count.Incr("handle-bucket-enforce-enc")
+				enforceBucketEncryption(b.acctID, b.bucket, region, sess)
+
+				if !theConfig["oneBucketReencrypt"].BoolVal { // else go on to fix the objects with the new key
+					progressDone(b.bucket)
 					theCtx.wg.Done()
 
 					continue
@@ -651,6 +958,16 @@ func handleBucket() { //nolint:cyclop,gocognit
 				setBucketKey(aws.String(b.bucket), key)
 			}
 
+			ownershipMode := theConfig["checkOwnershipMigration"].BoolVal
+			if ownershipMode && !startOwnershipMigration(b.acctID, b.bucket, sess) {
+				progressDone(b.bucket)
+				theCtx.wg.Done()
+
+				continue
+			}
+
+			go progressExpect(b.bucket, sess)
+
 			// start list objects
 			req := &s3.ListObjectsV2Input{Bucket: aws.String(b.bucket)}
 
@@ -672,9 +989,10 @@ func handleBucket() { //nolint:cyclop,gocognit
 					wg.Add(1)        // Done in handleObject
 					theCtx.wg.Add(1) // Done in handleObject
 					count.Incr("object-chan-add")
+					progressObjectListed(b.bucket)
 					runtime.Gosched()
 
-					theCtx.objectChan <- objectChanItem{b.acctID, b.bucket, key, region, wg}
+					theCtx.objectChan <- objectChanItem{b.acctID, b.bucket, key, region, wg, 0}
 				}
 
 				count.Incr("object-page-exit")
@@ -682,6 +1000,24 @@ func handleBucket() { //nolint:cyclop,gocognit
 				return true
 			})
 
+			progressListed(b.bucket, wg)
+
+			if ownershipMode {
+				wg.Wait() // needs every object checked before changing the bucket
+				finishOwnershipMigration(b.bucket, sess)
+			}
+
+			if theConfig["profileColumns"].BoolVal {
+				wg.Wait() // the bucket profile is the merge of all its files
+				finishBucketProfile(b.bucket)
+			}
+
+			if theConfig["checkDuplicates"].BoolVal {
+				wg.Wait() // duplicates are found once every object is fingerprinted
+				finishDedupeObjects(b.bucket, sess)
+				finishDedupeRows(b.bucket)
+			}
+
 			theCtx.wg.Done()
 		case <-time.After(time.Minute):
 			log.Println("Giving up on bucket channel after 1 minute with no traffic")
@@ -756,6 +1092,8 @@ func handleAccount() { //nolint:cyclop
 					if !theConfig["oneBucket"].BoolVal || theConfig["oneBucketName"].StrVal == aws.StringValue(b.Name) {
 						theCtx.wg.Add(1) // done in handleBucket
 						log.Println("Got a bucket", aws.StringValue(b.Name))
+						noteMetricBucket(*b.Name)
+						progressQueued(a, *b.Name)
 
 						theCtx.bucketChan <- bucketChanItem{a, *b.Name}
 
@@ -804,6 +1142,16 @@ func main() { //nolint:gocognit,cyclop
 		}
 	}
 
+	// --listRuns and --diffRuns read the run history and exit
+	if ok, err := runHistoryCommand(os.Args[1:]); ok {
+		if err != nil {
+			log.Println("Error reading run history", err)
+			os.Exit(errExit)
+		}
+
+		return
+	}
+
 	// save objects we have copied to disk
 	theCtx.doneObjects = set.New("doneObjects_2")
 
@@ -824,6 +1172,46 @@ func main() { //nolint:gocognit,cyclop
 		}
 	}
 
+	// which KMS key each account/bucket should default to
+	theCtx.keyTargets, err = readKeyTargetFile(theConfig["enforceKmsKeyFile"].StrVal)
+	if err != nil {
+		log.Println("Error opening kms key target file", err.Error())
+	}
+
+	// what the object ACLs should look like for threeAcl
+	if len(theConfig["desiredAclFile"].StrVal) > 0 {
+		theCtx.desiredACL, err = readDesiredACLFile(theConfig["desiredAclFile"].StrVal)
+		if err != nil {
+			log.Println("Error opening desired acl file", err.Error())
+		}
+	} else {
+		theCtx.desiredACL = threeACLRules()
+	}
+
+	// which files have a header row, overriding the per scanner setting
+	theCtx.headerRules, err = readHeaderRulesFile(theConfig["headerRulesFile"].StrVal)
+	if err != nil {
+		log.Println("Error opening header rules file", err.Error())
+	}
+
+	// the declared schema for checkSchema
+	theCtx.schema, err = readSchemaFile(theConfig["schemaFile"].StrVal)
+	if err != nil {
+		log.Println("Error reading schema file", err.Error())
+	}
+
+	if theConfig["checkSchema"].BoolVal && len(theCtx.schema) == 0 {
+		log.Println("checkSchema needs a schemaFile with at least one column")
+		os.Exit(errExit)
+	}
+
+	// the JSON paths for checkJsonl
+	theCtx.jsonPaths, err = parseJSONPaths(theConfig["jsonlPaths"].StrVal)
+	if err != nil || (theConfig["checkJsonl"].BoolVal && len(theCtx.jsonPaths) == 0) {
+		log.Println("checkJsonl needs jsonlPaths like a.b[0].c:string", err)
+		os.Exit(errExit)
+	}
+
 	// init the globals
 	atomic.StoreInt64(&theCtx.lastObj, makeTimestamp())
 
@@ -837,6 +1225,26 @@ func main() { //nolint:gocognit,cyclop
 	theCtx.keyRW = sync.RWMutex{}
 	theCtx.canonIDMap = make(map[string]string)
 	theCtx.canonRW = sync.RWMutex{}
+	theCtx.reports = make(map[string]*reportWriter)
+	theCtx.kmsKeys = make(map[string]*kmsKeyInfo)
+	theCtx.kmsAliases = make(map[string]string)
+	theCtx.kmsAliasScopes = make(map[string]bool)
+	theCtx.acctBlocks = make(map[string]publicBlock)
+	theCtx.ownership = make(map[string]*ownershipTally)
+	theCtx.orgAccts = make(map[string]string)
+	theCtx.aclShapes = make(map[string]map[string]*aclShape)
+	theCtx.profiles = make(map[string]*tableProfile)
+	theCtx.prefixHeaders = make(map[string]prefixHeader)
+	theCtx.dedupeObjs = make(map[string]map[dedupeGroup][]dedupeObj)
+	theCtx.dedupeRows = make(map[string]map[string]*rowScope)
+	theCtx.metrics = make(map[metricSeries]int64)
+	theCtx.metricBuckets = make(map[string]bool)
+	theCtx.metricNames = make(map[string]metricSeries)
+	theCtx.progress = make(map[string]*bucketProgress)
+	theCtx.progressStart = time.Now()
+	theCtx.rangeSem = make(chan struct{}, max(theConfig["rangeScanConcurrency"].IntVal, 1))
+
+	openHistory()
 
 	// start go routines
 	go handleAccount()
@@ -870,13 +1278,18 @@ func main() { //nolint:gocognit,cyclop
 			return
 		}
 
+		// the whole org list is read before any account is queued so
+		// the policy checks see every org account
+		active := make([]string, 0, smallChannelBuffer)
+
 		for { // to handle paginatin - break is down in the "no next token"
 			for _, r := range la.Accounts {
 				fmt.Println("Account", r.Status, r)
 
+				theCtx.orgAccts[aws.StringValue(r.Id)] = aws.StringValue(r.Name)
+
 				if *r.Status == "ACTIVE" {
-					theCtx.accountChan <- *r.Id
-					theCtx.wg.Add(1) // done in handleBucket
+					active = append(active, *r.Id)
 				}
 			}
 
@@ -893,6 +1306,11 @@ func main() { //nolint:gocognit,cyclop
 				break
 			}
 		}
+
+		for _, a := range active {
+			theCtx.wg.Add(1) // done in handleBucket
+			theCtx.accountChan <- a
+		}
 	} else {
 		log.Println("Just doing one account")
 
@@ -901,7 +1319,13 @@ func main() { //nolint:gocognit,cyclop
 		theCtx.wg.Add(1) // done in handleBucket
 	}
 
-	// start the profiler
+	// start the profiler, and /metrics on the same listener
+	count.SetMetricReporter(reportMetrics)
+	http.HandleFunc("/metrics", serveMetrics)
+	http.HandleFunc("/status", serveStatus)
+
+	go progressLoop()
+
 	go func() {
 		if len(theConfig["profListen"].StrVal) > 0 {
 			log.Println(http.ListenAndServe(theConfig["profListen"].StrVal, nil))
@@ -918,7 +1342,12 @@ func main() { //nolint:gocognit,cyclop
 		theCtx.wg.Wait()
 	}
 
+	writeACLShapes()
+	closeReports()
 	count.Drain()
 	count.LogCounters()
+	syncMetricTotals()
+	writeRunSummary()
+	closeHistory()
 	log.Println("Exiting", makeTimestamp()-atomic.LoadInt64(&theCtx.lastObj))
 }
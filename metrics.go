@@ -0,0 +1,174 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// metricSeries is one Prometheus series: a counter name with the
+// bucket suffix, if any, taken off as a label.
+type metricSeries struct {
+	name   string
+	bucket string
+}
+
+// noteMetricBucket remembers a bucket name so counters ending in it
+// are exported with a bucket label.
+func noteMetricBucket(bucket string) {
+	theCtx.metricsRW.Lock()
+	theCtx.metricBuckets[bucket] = true
+	theCtx.metricsRW.Unlock()
+}
+
+// unDashedMetrics are the counters with the bucket stuck straight on,
+// "403 error<bucket>".
+var unDashedMetrics = []string{"403 error", "404 error"}
+
+// splitMetricName finds the longest known bucket name the counter ends
+// in after a "-", so "a-b-c" is bucket "b-c" if that's a bucket, and a
+// bucket named "c" doesn't split "a-bc".  Must hold metricsRW.
+func splitMetricName(name string) metricSeries {
+	for _, p := range unDashedMetrics {
+		if b, ok := strings.CutPrefix(name, p); ok && theCtx.metricBuckets[b] {
+			return metricSeries{p, b}
+		}
+	}
+
+	for i := 1; i < len(name); i++ {
+		if name[i-1] == '-' && theCtx.metricBuckets[name[i:]] {
+			return metricSeries{name[:i-1], name[i:]}
+		}
+	}
+
+	return metricSeries{name: name}
+}
+
+// promName makes a counter name a valid Prometheus metric name.
+func promName(name string) string {
+	var b strings.Builder
+
+	b.WriteString(theConfig["metricsPrefix"].StrVal)
+	b.WriteByte('_')
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+// promLabel escapes a label value.
+func promLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// reportMetrics is the go-counter callback: it adds each minute's
+// deltas to the running totals /metrics serves.  New series past
+// metricsMaxSeries are dropped so per-file counters can't grow it
+// without bound, except the ones the run summary needs.
+func reportMetrics(ms []count.MetricReport) {
+	theCtx.metricsRW.Lock()
+	defer theCtx.metricsRW.Unlock()
+
+	dropped := int64(0)
+
+	for _, m := range ms {
+		if m.Name == "" {
+			continue
+		}
+
+		s := splitMetricName(m.Name)
+
+		_, ok := theCtx.metrics[s]
+		if !ok && len(theCtx.metrics) >= theConfig["metricsMaxSeries"].IntVal && summaryKind(s.name) == "" {
+			dropped++
+
+			continue
+		}
+
+		theCtx.metrics[s] += m.Delta
+		theCtx.metricNames[m.Name] = s
+	}
+
+	if dropped > 0 {
+		count.IncrDelta("metrics-series-dropped", dropped)
+	}
+}
+
+// syncMetricTotals sets every series to its counter's current value.
+// The reporter only gets deltas, and a minute's report still running
+// when the last LogCounters is can land after it, so at exit the
+// totals are read from the counters themselves.  Call after the last
+// LogCounters, which has reported every counter's name.
+func syncMetricTotals() {
+	theCtx.metricsRW.Lock()
+	defer theCtx.metricsRW.Unlock()
+
+	for s := range theCtx.metrics {
+		theCtx.metrics[s] = 0
+	}
+
+	for name, s := range theCtx.metricNames {
+		theCtx.metrics[s] += count.ReadSync(name)
+	}
+}
+
+// serveMetrics writes the counters in the Prometheus text format, plus
+// gauges for the work channels' depths.
+func serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	theCtx.metricsRW.Lock()
+
+	series := make([]metricSeries, 0, len(theCtx.metrics))
+	values := make(map[metricSeries]int64, len(theCtx.metrics))
+
+	for s, v := range theCtx.metrics {
+		series = append(series, s)
+		values[s] = v
+	}
+
+	theCtx.metricsRW.Unlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+
+		return series[i].bucket < series[j].bucket
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	last := ""
+
+	for _, s := range series {
+		name := promName(s.name) + "_total"
+		if name != last {
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+			last = name
+		}
+
+		if s.bucket == "" {
+			fmt.Fprintf(w, "%s %d\n", name, values[s])
+		} else {
+			fmt.Fprintf(w, "%s{bucket=\"%s\"} %d\n", name, promLabel(s.bucket), values[s])
+		}
+	}
+
+	name := promName("channel-depth")
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(w, "%s{channel=\"account\"} %d\n", name, len(theCtx.accountChan))
+	fmt.Fprintf(w, "%s{channel=\"bucket\"} %d\n", name, len(theCtx.bucketChan))
+	fmt.Fprintf(w, "%s{channel=\"object\"} %d\n", name, len(theCtx.objectChan))
+}
@@ -0,0 +1,281 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+// errSSECNoKey is the reason SSE-C objects are skipped.
+var errSSECNoKey = errors.New("SSE-C object, can't copy without the customer key")
+
+// migrateHeader is the header row of the migration report.
+var migrateHeader = []string{
+	"source_bucket", "source_key", "target_bucket", "target_key",
+	"size", "sse", "kms_key", "status", "error",
+}
+
+// copySourceFor URL encodes bucket/key for CopySource.
+func copySourceFor(bucket string, key string) string {
+	return strings.ReplaceAll(url.PathEscape(bucket+"/"+key), "%2F", "/")
+}
+
+// migrateTargetKey rewrites the source prefix to the target prefix.
+func migrateTargetKey(k string) string {
+	return theConfig["migrateTargetPrefix"].StrVal +
+		strings.TrimPrefix(k, theConfig["migrateSourcePrefix"].StrVal)
+}
+
+// migrateTargetSess logs into the target account and region, which
+// default to the source bucket's.
+func migrateTargetSess(acctID string, region string) *session.Session {
+	if a := theConfig["migrateTargetAcct"].StrVal; a != "" {
+		acctID = a
+	}
+
+	if r := theConfig["migrateTargetRegion"].StrVal; r != "" {
+		region = r
+	}
+
+	sess := getSessForAcct(acctID)
+	if sess == nil {
+		return nil
+	}
+
+	if region != aws.StringValue(sess.Config.Region) {
+		var err error
+
+		sess, err = session.NewSession(sess.Config.Copy(&aws.Config{Region: aws.String(region)}))
+		if err != nil {
+			logCountErr(err, "Can't create session for migrate target region "+region)
+
+			return nil
+		}
+	}
+
+	return sess
+}
+
+// migrateCopyInput sets up the copy with the configured SSE.
+func migrateCopyInput(b string, k string, tb string, tk string) *s3.CopyObjectInput {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(tb),
+		Key:        aws.String(tk),
+		CopySource: aws.String(copySourceFor(b, k)),
+	}
+
+	switch sse := theConfig["migrateTargetSSE"].StrVal; sse {
+	case s3.ServerSideEncryptionAwsKms, s3.ServerSideEncryptionAwsKmsDsse:
+		input.ServerSideEncryption = aws.String(sse)
+
+		if key := theConfig["migrateTargetKmsKey"].StrVal; key != "" {
+			input.SSEKMSKeyId = aws.String(key)
+		}
+	case "":
+		// target bucket default
+	default:
+		input.ServerSideEncryption = aws.String(sse)
+	}
+
+	return input
+}
+
+// verifyMigratedObject checks the target has the same size and the
+// SSE we asked for.
+func verifyMigratedObject(tb string, tk string, head s3.HeadObjectOutput, svc *s3.S3) error {
+	count.Incr("aws-head-object-migrate")
+
+	out, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(tb), Key: aws.String(tk)})
+	if err != nil {
+		return err
+	}
+
+	if aws.Int64Value(out.ContentLength) != aws.Int64Value(head.ContentLength) {
+		return fmt.Errorf("size mismatch %d != %d", //nolint:err113
+			aws.Int64Value(out.ContentLength), aws.Int64Value(head.ContentLength))
+	}
+
+	want := theConfig["migrateTargetSSE"].StrVal
+	if want != "" && aws.StringValue(out.ServerSideEncryption) != want {
+		return fmt.Errorf("sse mismatch %s != %s", //nolint:err113
+			aws.StringValue(out.ServerSideEncryption), want)
+	}
+
+	// only with SSE-S3 or none is the ETag of a single part upload the
+	// MD5 on both sides; KMS, DSSE and SSE-C ETags are something else
+	if etagIsMD5(head) && etagIsMD5(*out) &&
+		!strings.Contains(aws.StringValue(head.ETag), "-") &&
+		aws.StringValue(out.ETag) != aws.StringValue(head.ETag) {
+		return fmt.Errorf("etag mismatch %s != %s", //nolint:err113
+			aws.StringValue(out.ETag), aws.StringValue(head.ETag))
+	}
+
+	return nil
+}
+
+// etagIsMD5 is true if the object's encryption leaves its ETag the MD5.
+func etagIsMD5(head s3.HeadObjectOutput) bool {
+	switch objectEncType(head) {
+	case encTypeNone, encTypeSSES3:
+		return true
+	}
+
+	return false
+}
+
+// migrateBackoff is how long to wait before a retry of the object.
+func migrateBackoff(tries int) time.Duration {
+	return min(time.Duration(delayBaseMsecs<<tries)*time.Millisecond, slowDownSeconds*time.Second)
+}
+
+// migrateDeleteSource deletes the source of a verified copy.  Until
+// it succeeds the object is only "copied", so a rerun retries the
+// delete without copying again.  Returns the report status.
+func migrateDeleteSource(b string, k string, doneKey string, sess *session.Session) (string, error) {
+	if _, err := deleteObject(k, b, sess); err != nil {
+		count.Incr("migrate-delete-source-failed")
+
+		return "delete-source-failed", err
+	}
+
+	count.Incr("migrate-source-deleted")
+	theCtx.doneObjects.Add(doneKey)
+
+	return "verified-source-deleted", nil
+}
+
+// migrateObject copies one object to reencryptToTargetBucket with
+// the configured SSE, verifies it and optionally deletes the source.
+// Finished objects go in doneObjects so a rerun picks up where it
+// left off; with migrateDeleteSource an object is finished once its
+// source is gone.  Returns true if the error is retryable.
+func migrateObject( //nolint:cyclop
+	kb objectChanItem,
+	head s3.HeadObjectOutput,
+	tooBig bool,
+	sess *session.Session,
+) bool {
+	b, k := kb.bucket, kb.object
+	tb := theConfig["reencryptToTargetBucket"].StrVal
+	tk := migrateTargetKey(k)
+
+	if tb == "" {
+		count.Incr("migrate-no-target-bucket")
+
+		return false
+	}
+
+	if !strings.HasPrefix(k, theConfig["migrateSourcePrefix"].StrVal) {
+		count.Incr("migrate-skip-prefix")
+
+		return false
+	}
+
+	row := func(status string, err error) {
+		e := ""
+		if err != nil {
+			e = err.Error()
+		}
+
+		writeReportRow(theConfig["migrateReport"].StrVal, migrateHeader, []string{
+			b, k, tb, tk, strconv.FormatInt(aws.Int64Value(head.ContentLength), 10),
+			theConfig["migrateTargetSSE"].StrVal, theConfig["migrateTargetKmsKey"].StrVal,
+			status, e,
+		})
+	}
+
+	if objectEncType(head) == encTypeSSEC {
+		fmt.Println("Skipping SSE-C object, can't copy without the customer key", b, k)
+		count.Incr("migrate-skip-sse-c")
+		row("skipped", errSSECNoKey)
+
+		return false
+	}
+
+	doneKey := "migrate-" + keyName(b, k)
+	if theCtx.doneObjects.InSet(doneKey) {
+		count.Incr("migrate-skip-done")
+
+		return false
+	}
+
+	if theConfig["readOnly"].StrVal != danger || theConfig["setToDangerToMigrate"].StrVal != danger {
+		fmt.Println("Would migrate", b, k, "to", tb, tk)
+		count.Incr("migrate-dry-run")
+		row("dry-run", nil)
+
+		return false
+	}
+
+	copiedKey := "migrate-copied-" + keyName(b, k)
+	if theConfig["migrateDeleteSource"].BoolVal && theCtx.doneObjects.InSet(copiedKey) {
+		// copied and verified before, only the delete is left
+		count.Incr("migrate-delete-pending")
+		row(migrateDeleteSource(b, k, doneKey, sess))
+
+		return false
+	}
+
+	if tooBig {
+		fmt.Println("Too big to migrate with one copy", b, k)
+		count.Incr("migrate-skip-too-big")
+		row("skip-too-big", nil)
+
+		return false
+	}
+
+	tSess := migrateTargetSess(kb.acctID, kb.region)
+	if tSess == nil {
+		count.Incr("migrate-no-target-session")
+
+		return false
+	}
+
+	tSvc := s3.New(tSess)
+
+	count.Incr("aws-copy-migrate")
+
+	_, err := tSvc.CopyObject(migrateCopyInput(b, k, tb, tk))
+	if err != nil {
+		logCountErrTag(err, "migrate CopyObject failed "+b+"/"+k, b)
+		count.Incr("migrate-copy-failed")
+		row("copy-failed", err)
+
+		return isRetryableErr(err)
+	}
+
+	err = verifyMigratedObject(tb, tk, head, tSvc)
+	if err != nil {
+		fmt.Println("ERROR: migrated object doesn't verify", b, k, tb, tk, err)
+		count.Incr("migrate-verify-failed")
+		row("verify-failed", err)
+
+		return false // needs a human
+	}
+
+	count.Incr("migrate-verified")
+	count.Incr("migrate-verified-" + b)
+	count.IncrDelta("migrate-bytes", aws.Int64Value(head.ContentLength))
+
+	if !theConfig["migrateDeleteSource"].BoolVal {
+		theCtx.doneObjects.Add(doneKey)
+		row("verified", nil)
+
+		return false
+	}
+
+	theCtx.doneObjects.Add(copiedKey)
+	row(migrateDeleteSource(b, k, doneKey, sess))
+
+	return false
+}
@@ -3,8 +3,9 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"path"
 	"strings"
@@ -16,14 +17,14 @@ import (
 )
 
 const (
-	scannerBufSize = 1024 * 1024 // 1MB max line length for wide TSVs
+	scannerBufSize = 1024 * 1024 // read buffer for the record reader
 	perCent        = 100
 )
 
-// findFieldIndex looks for fieldName in a tab-separated header line.
+// findFieldIndex looks for fieldName in a header row.
 // Returns the index if found, or -1.
-func findFieldIndex(headerLine string, fieldName string) int {
-	for i, col := range strings.Split(headerLine, "\t") {
+func findFieldIndex(headers []string, fieldName string) int {
+	for i, col := range headers {
 		if strings.EqualFold(strings.TrimSpace(col), fieldName) {
 			return i
 		}
@@ -32,11 +33,192 @@ func findFieldIndex(headerLine string, fieldName string) int {
 	return -1
 }
 
-// streamAndCountNulls streams an S3 object line by line as a TSV,
-// counting how many times the field at fieldIndex is NULL vs non-NULL.
-// If fieldName is non-empty, the first line is treated as a header
-// and used to look up the column index by name.
-func streamAndCountNulls(bucket, key string, fieldIndex int, fieldName string, sess *session.Session) { //nolint:cyclop
+// countMalformed logs and counts a row the record reader didn't like.
+// Returns false for a real read error that should stop the scan.
+func countMalformed(err error, prefix string, bucket string, key string) bool {
+	var merr *malformedError
+
+	if !errors.As(err, &merr) {
+		return false
+	}
+
+	fmt.Println("Malformed row", bucket, key, merr)
+	count.Incr(prefix + "-malformed-row")
+	count.Incr(prefix + "-malformed-row-" + bucket)
+
+	return true
+}
+
+// nullTally is the rows of one file, or one range of it.
+type nullTally struct {
+	lines   int
+	null    int
+	total   int
+	missing int
+}
+
+// add counts one row's field as null, non-null or missing.
+func (t *nullTally) add(rec *record, fieldIndex int, bucket string, baseName string) {
+	t.lines++
+
+	count.Incr("row")
+	count.Incr("row-" + bucket)
+	count.Incr("row-" + baseName)
+
+	fields := rec.fields
+	if fieldIndex >= len(fields) {
+		count.Incr("null-check-field-missing")
+		count.Incr("null-check-field-missing-" + bucket)
+		count.Incr("null-check-field-missing-" + baseName)
+
+		t.missing++
+
+		return
+	}
+
+	t.total++
+
+	val := fields[fieldIndex]
+	if isNullValue(val) {
+		t.null++
+
+		count.Incr("field-null")
+		count.Incr("field-null-" + bucket)
+		count.Incr("field-null-" + baseName)
+	} else {
+		count.Incr("field-non-null")
+		count.Incr("field-non-null-" + bucket)
+		count.Incr("field-non-null-" + baseName)
+	}
+}
+
+// merge adds o into t.
+func (t *nullTally) merge(o nullTally) {
+	t.lines += o.lines
+	t.null += o.null
+	t.total += o.total
+	t.missing += o.missing
+}
+
+// nullHeaderIndex looks fieldName up in the header row, falling back
+// to fieldIndex.
+func nullHeaderIndex(headers []string, fieldName string, fieldIndex int, bucket string, key string) int {
+	if fieldName == "" {
+		return fieldIndex
+	}
+
+	idx := findFieldIndex(headers, fieldName)
+	if idx < 0 {
+		fmt.Println("Column", fieldName, "not found in header, using index", fieldIndex, "in", bucket, key)
+		count.Incr("null-check-header-not-found")
+
+		return fieldIndex
+	}
+
+	fmt.Println("Found column", fieldName, "at index", idx, "in", bucket, key)
+	count.Incr("null-check-header-found")
+
+	return idx
+}
+
+// finishNullCount counts a file's null percentage and lines.
+func finishNullCount(bucket string, key string, t nullTally) {
+	if t.total > 0 {
+		pct := (t.null * perCent) / t.total
+
+		count.IncrDelta("null-pct-"+path.Base(key), int64(pct))
+	}
+
+	fmt.Println("Scanned", t.lines, "lines from", bucket, key)
+	count.IncrDelta("null-check-lines", int64(t.lines))
+}
+
+// countNullsRanged is streamAndCountNulls for a big object, with the
+// byte ranges scanned at once and their tallies merged.
+func countNullsRanged(bucket string, key string, fieldIndex int, fieldName string,
+	head *s3.HeadObjectOutput, sess *session.Session,
+) (nullTally, bool) {
+	d := dialectFor("nullCheckDelimiter", fieldName != "", key)
+	baseName := path.Base(key)
+	tallies := make([]nullTally, rangeParts(objectSize(head)))
+	total := nullTally{}
+
+	err := scanRanges(bucket, key, head, d, "null-check",
+		func(fields []string) {
+			total.lines++ // the header
+			fieldIndex = nullHeaderIndex(fields, fieldName, fieldIndex, bucket, key)
+		},
+		func(part int, rec *record, _ int64) {
+			tallies[part].add(rec, fieldIndex, bucket, baseName)
+		},
+		sess)
+	if err != nil {
+		logCountErrTag(err, "range scan failed "+bucket+"/"+key, bucket)
+		count.Incr("null-check-scan-error")
+
+		return total, false
+	}
+
+	for _, t := range tallies {
+		total.merge(t)
+	}
+
+	finishNullCount(bucket, key, total)
+
+	return total, true
+}
+
+// streamAndCountNulls streams an S3 object record by record (tab
+// separated unless nullCheckDelimiter says otherwise), counting how
+// many times the field at fieldIndex is NULL vs non-NULL.  If
+// fieldName is non-empty, the first row is treated as a header and
+// used to look up the column index by name.  Objects over
+// rangeScanMinBytes are scanned as parallel byte ranges.
+// With nullCheckSelect S3 Select does the counting, falling back to
+// streaming for objects it can't handle; nullCheckSelectVerify does
+// both and compares them.
+func streamAndCountNulls(bucket, key string, fieldIndex int, fieldName string,
+	head *s3.HeadObjectOutput, sess *session.Session,
+) {
+	if !theConfig["nullCheckSelect"].BoolVal {
+		streamNulls(bucket, key, fieldIndex, fieldName, head, sess)
+
+		return
+	}
+
+	st, ok := selectCountNulls(bucket, key, fieldIndex, fieldName, head, sess)
+	if !ok {
+		count.Incr("null-check-select-fallback")
+		count.Incr("null-check-select-fallback-" + bucket)
+		streamNulls(bucket, key, fieldIndex, fieldName, head, sess)
+
+		return
+	}
+
+	if !theConfig["nullCheckSelectVerify"].BoolVal {
+		countSelectNulls(bucket, key, st)
+
+		return
+	}
+
+	if t, ok := streamNulls(bucket, key, fieldIndex, fieldName, head, sess); ok {
+		verifySelectNulls(bucket, key, st, t)
+	}
+}
+
+// streamNulls reads the object itself to count nulls: the Parquet or
+// ORC column, parallel byte ranges, or one stream.
+func streamNulls(bucket, key string, fieldIndex int, fieldName string,
+	head *s3.HeadObjectOutput, sess *session.Session,
+) (nullTally, bool) {
+	if f := columnarFormat(key); f != "" {
+		return countNullsColumnar(bucket, key, f, fieldIndex, fieldName, sess)
+	}
+
+	if rangeScannable(key, head) {
+		return countNullsRanged(bucket, key, fieldIndex, fieldName, head, sess)
+	}
+
 	svc := s3.New(sess)
 
 	count.Incr("aws-get-object")
@@ -48,81 +230,59 @@ func streamAndCountNulls(bucket, key string, fieldIndex int, fieldName string, s
 	if err != nil {
 		logCountErrTag(err, "GetObject failed "+bucket+"/"+key, bucket)
 
-		return
+		return nullTally{}, false
 	}
 
 	defer resp.Body.Close()
 
-	scanner := bufio.NewScanner(resp.Body)
-	buf := make([]byte, 0, scannerBufSize)
-	scanner.Buffer(buf, scannerBufSize)
-
-	lineNum := 0
-	baseName := path.Base(key)
+	body, done, err := decodedBody(bucket, key, resp)
+	if err != nil {
+		log.Println("Error decompressing object", bucket, key, err)
+		count.Incr("null-check-decompress-error")
 
-	// If a field name is configured, try to find it in the header row.
-	if fieldName != "" && scanner.Scan() {
-		lineNum++
-
-		idx := findFieldIndex(scanner.Text(), fieldName)
-		if idx >= 0 {
-			fieldIndex = idx
-			fmt.Println("Found column", fieldName, "at index", fieldIndex, "in", bucket, key)
-			count.Incr("null-check-header-found")
-		} else {
-			fmt.Println("Column", fieldName, "not found in header, using index", fieldIndex, "in", bucket, key)
-			count.Incr("null-check-header-not-found")
-		}
+		return nullTally{}, false
 	}
 
-	fileNull := 0
-	fileTotal := 0
+	defer done()
 
-	for scanner.Scan() {
-		lineNum++
-
-		count.Incr("row")
-		count.Incr("row-" + bucket)
-		count.Incr("row-" + baseName)
+	d := dialectFor("nullCheckDelimiter", fieldName != "", key)
+	rr := newRecordReader(body, d)
+	baseName := path.Base(key)
+	t := nullTally{}
 
-		fields := strings.Split(scanner.Text(), "\t")
-		if fieldIndex >= len(fields) {
-			count.Incr("null-check-field-missing")
-			count.Incr("null-check-field-missing-" + bucket)
-			count.Incr("null-check-field-missing-" + baseName)
+	// If there is a header and a field name, find it in the header row.
+	if d.hasHeader {
+		rec, err := rr.Read()
+		if err != nil && !countMalformed(err, "null-check", bucket, key) && !errors.Is(err, io.EOF) {
+			log.Println("Error scanning object", bucket, key, err)
+			count.Incr("null-check-scan-error")
 
-			continue
+			return t, false
 		}
 
-		fileTotal++
-
-		val := fields[fieldIndex]
-		if val == "" || strings.EqualFold(val, "NULL") || val == "\\N" {
-			fileNull++
-
-			count.Incr("field-null")
-			count.Incr("field-null-" + bucket)
-			count.Incr("field-null-" + baseName)
-		} else {
-			count.Incr("field-non-null")
-			count.Incr("field-non-null-" + bucket)
-			count.Incr("field-non-null-" + baseName)
+		if rec != nil {
+			t.lines++
+			fieldIndex = nullHeaderIndex(rec.fields, fieldName, fieldIndex, bucket, key)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Println("Error scanning object", bucket, key, err)
-		count.Incr("null-check-scan-error")
+	for {
+		rec, err := rr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
 
-		return
-	}
+		if err != nil && !countMalformed(err, "null-check", bucket, key) {
+			log.Println("Error scanning object", bucket, key, err)
+			count.Incr("null-check-scan-error")
 
-	if fileTotal > 0 {
-		pct := (fileNull * perCent) / fileTotal
+			return t, false
+		}
 
-		count.IncrDelta("null-pct-"+baseName, int64(pct))
+		t.add(rec, fieldIndex, bucket, baseName)
 	}
 
-	fmt.Println("Scanned", lineNum, "lines from", bucket, key)
-	count.IncrDelta("null-check-lines", int64(lineNum))
+	finishNullCount(bucket, key, t)
+
+	return t, true
 }
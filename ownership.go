@@ -0,0 +1,250 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+// ownershipHeader is the header row of the ownership compatibility report.
+var ownershipHeader = []string{
+	"account", "bucket", "key", "owner", "owner_account", "issue", "detail", "action",
+}
+
+// ownershipTally is what the object scan found in one bucket.
+type ownershipTally struct {
+	acctID        string
+	ownerID       string
+	bucketGrants  []string // non owner grants on the bucket ACL
+	objects       int64
+	foreignOwned  int64
+	droppedGrants int64
+	fixed         int64
+	fixFailed     int64
+	aclErrors     int64 // objects whose ACL couldn't be read
+	skipped       int64 // foreign owned objects a copy can't fix
+}
+
+// ownershipFixAllowed is the readOnly/danger guard for this mode.
+func ownershipFixAllowed() bool {
+	return theConfig["readOnly"].StrVal == danger &&
+		theConfig["setToDangerToEnforceOwnership"].StrVal == danger
+}
+
+// writeOwnershipRow adds a row to the ownership compatibility report.
+func writeOwnershipRow(t *ownershipTally, bucket, key, owner, issue, detail, action string) {
+	writeReportRow(theConfig["ownershipReport"].StrVal, ownershipHeader, []string{
+		t.acctID, bucket, key, owner, acctForCanonID(owner), issue, detail, action,
+	})
+}
+
+// startOwnershipMigration reads the bucket owner and bucket ACL so the
+// object scan can compare against them.  Returns false if the bucket
+// can't be checked.
+func startOwnershipMigration(acctID string, bucket string, sess *session.Session) bool {
+	svc := s3.New(sess)
+	t := &ownershipTally{acctID: resolveAcctID(acctID, sess)}
+
+	ownership, err := getBucketOwnership(bucket, svc)
+	if err == nil && ownership == s3.ObjectOwnershipBucketOwnerEnforced {
+		fmt.Println("Already BucketOwnerEnforced", bucket)
+		count.Incr("ownership-already-enforced")
+
+		return false
+	}
+
+	count.Incr("aws-get-bucket-acl")
+
+	acl, err := svc.GetBucketAcl(&s3.GetBucketAclInput{Bucket: aws.String(bucket)})
+	if err != nil || acl.Owner == nil {
+		logCountErrTag(err, "GetBucketAcl failed "+bucket, bucket)
+
+		return false
+	}
+
+	t.ownerID = aws.StringValue(acl.Owner.ID)
+
+	for _, g := range acl.Grants {
+		if g.Grantee != nil && aws.StringValue(g.Grantee.ID) != t.ownerID {
+			t.bucketGrants = append(t.bucketGrants, granteeLabel(g.Grantee)+":"+aws.StringValue(g.Permission))
+		}
+	}
+
+	theCtx.ownershipRW.Lock()
+	theCtx.ownership[bucket] = t
+	theCtx.ownershipRW.Unlock()
+
+	return true
+}
+
+// checkObjectOwnership looks at one object's ACL for things
+// BucketOwnerEnforced would change: another account owning it, or
+// grants to anyone but the bucket owner that would be dropped.  In
+// danger mode foreign owned objects are copied in place by the
+// bucket owner so the bucket owner owns them.
+func checkObjectOwnership(b string, k string, head *s3.HeadObjectOutput, sess *session.Session) { //nolint:cyclop
+	theCtx.ownershipRW.RLock()
+	t, ok := theCtx.ownership[b]
+	theCtx.ownershipRW.RUnlock()
+
+	if !ok {
+		count.Incr("ownership-no-tally")
+
+		return
+	}
+
+	atomic.AddInt64(&t.objects, 1)
+
+	svc := s3.New(sess)
+
+	count.Incr("aws-get-object-acl-ownership")
+
+	acl, err := svc.GetObjectAcl(&s3.GetObjectAclInput{Bucket: aws.String(b), Key: aws.String(k)})
+	if err != nil {
+		logCountErrTag(err, "GetObjectAcl failed "+b+"/"+k, b)
+		atomic.AddInt64(&t.aclErrors, 1)
+		writeOwnershipRow(t, b, k, "", "acl-unreadable", err.Error(), "none")
+
+		return
+	}
+
+	owner := ""
+	if acl.Owner != nil {
+		owner = aws.StringValue(acl.Owner.ID)
+	}
+
+	for _, g := range acl.Grants {
+		if g.Grantee == nil || aws.StringValue(g.Grantee.ID) == t.ownerID {
+			continue
+		}
+
+		atomic.AddInt64(&t.droppedGrants, 1)
+		count.Incr("ownership-dropped-grant")
+		writeOwnershipRow(t, b, k, owner, "grant-dropped",
+			granteeLabel(g.Grantee)+":"+aws.StringValue(g.Permission), "none")
+	}
+
+	if owner == t.ownerID {
+		return
+	}
+
+	atomic.AddInt64(&t.foreignOwned, 1)
+	count.Incr("ownership-foreign-owner")
+	count.Incr("ownership-foreign-owner-" + b)
+
+	switch {
+	case !ownershipFixAllowed():
+		writeOwnershipRow(t, b, k, owner, "foreign-owner", "", "dry-run")
+	case head == nil:
+		atomic.AddInt64(&t.fixFailed, 1)
+		writeOwnershipRow(t, b, k, owner, "foreign-owner", "no HeadObject", "fix-failed")
+	case strings.HasSuffix(k, "%%%") || objectEncType(*head) == encTypeSSEC:
+		// reencryptObject skips these without copying, so they stay foreign
+		atomic.AddInt64(&t.skipped, 1)
+		count.Incr("ownership-fix-skipped")
+		writeOwnershipRow(t, b, k, owner, "foreign-owner", "can't copy "+objectEncType(*head)+" object", "skipped")
+	default:
+		theCtx.keyRW.RLock()
+		_, hasKey := theCtx.keyIDMap[b]
+		theCtx.keyRW.RUnlock()
+
+		// copying in place with the bucket owner's session makes it the owner
+		if reencryptObject(b, k, hasKey, *head, sess) {
+			atomic.AddInt64(&t.fixFailed, 1)
+			count.Incr("ownership-fix-failed")
+			writeOwnershipRow(t, b, k, owner, "foreign-owner", "", "fix-failed")
+
+			return
+		}
+
+		atomic.AddInt64(&t.fixed, 1)
+		count.Incr("ownership-fixed")
+		writeOwnershipRow(t, b, k, owner, "foreign-owner", "", "copied-in-place")
+	}
+}
+
+// finishOwnershipMigration runs after all the bucket's objects are
+// checked.  It writes the bucket summary and, in danger mode with
+// nothing left in the way, sets BucketOwnerEnforced.  Object grants
+// it would drop are in the way unless ownershipAllowDroppedGrants.
+func finishOwnershipMigration(bucket string, sess *session.Session) {
+	theCtx.ownershipRW.Lock()
+	t, ok := theCtx.ownership[bucket]
+	delete(theCtx.ownership, bucket)
+	theCtx.ownershipRW.Unlock()
+
+	if !ok {
+		return
+	}
+
+	detail := fmt.Sprintf("objects=%d foreign_owned=%d dropped_grants=%d fixed=%d fix_failed=%d "+
+		"skipped=%d acl_errors=%d bucket_grants=%v",
+		t.objects, t.foreignOwned, t.droppedGrants, t.fixed, t.fixFailed, t.skipped, t.aclErrors, t.bucketGrants)
+	action := "dry-run"
+
+	switch {
+	case len(t.bucketGrants) > 0:
+		action = "blocked-by-bucket-acl"
+
+		count.Incr("ownership-blocked-bucket-acl")
+	case t.aclErrors > 0 || t.skipped > 0:
+		// an object we couldn't read or copy may still be foreign owned
+		if ownershipFixAllowed() {
+			action = "blocked-by-unchecked-objects"
+		}
+
+		count.Incr("ownership-blocked-unchecked")
+	case t.droppedGrants > 0 && !theConfig["ownershipAllowDroppedGrants"].BoolVal:
+		// enforcing would take away access these grants give
+		if ownershipFixAllowed() {
+			action = "blocked-by-object-grants"
+		}
+
+		count.Incr("ownership-blocked-grants")
+	case t.foreignOwned > t.fixed:
+		if ownershipFixAllowed() {
+			action = "blocked-by-objects"
+		}
+
+		count.Incr("ownership-blocked-objects")
+	case ownershipFixAllowed():
+		action = "set-bucket-owner-enforced"
+
+		count.Incr("aws-put-bucket-ownership")
+
+		_, err := s3.New(sess).PutBucketOwnershipControls(&s3.PutBucketOwnershipControlsInput{
+			Bucket: aws.String(bucket),
+			OwnershipControls: &s3.OwnershipControls{
+				Rules: []*s3.OwnershipControlsRule{{
+					ObjectOwnership: aws.String(s3.ObjectOwnershipBucketOwnerEnforced),
+				}},
+			},
+		})
+		if err != nil {
+			logCountErrTag(err, "PutBucketOwnershipControls failed "+bucket, bucket)
+
+			action = "put-ownership-failed"
+		} else {
+			fmt.Println("Successfully set BucketOwnerEnforced", bucket)
+			count.Incr("ownership-enforced")
+		}
+	}
+
+	log.Println("Ownership migration", bucket, action, detail)
+	writeOwnershipRow(t, bucket, "", t.ownerID, "bucket-summary", detail, action)
+	count.IncrDelta("ownership-objects", t.objects)
+
+	if t.foreignOwned == 0 && t.droppedGrants == 0 && t.aclErrors == 0 && len(t.bucketGrants) == 0 {
+		count.Incr("ownership-bucket-compatible")
+	} else {
+		count.Incr("ownership-bucket-incompatible")
+	}
+}
@@ -0,0 +1,245 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	sseHeaderKey      = "s3:x-amz-server-side-encryption"
+	errCodeNoPolicy   = "NoSuchBucketPolicy"
+	policyVersion2012 = "2012-10-17"
+)
+
+var errPolicyValue = errors.New("policy value isn't a string, bool, number or list of them")
+
+// stringOrSlice is the IAM JSON thing where one value can be
+// a string or a list of strings.  Condition values can also be bools
+// and numbers, which are kept as their JSON text.
+type stringOrSlice []string
+
+// policyScalar is a string, bool or number as a string.
+func policyScalar(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case bool:
+		return strconv.FormatBool(x), true
+	case json.Number:
+		return x.String(), true
+	}
+
+	return "", false
+}
+
+// UnmarshalJSON takes either "x", true, 3 or a list of them.
+func (s *stringOrSlice) UnmarshalJSON(b []byte) error {
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	if one, ok := policyScalar(v); ok {
+		*s = []string{one}
+
+		return nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return errPolicyValue
+	}
+
+	many := make([]string, 0, len(list))
+
+	for _, e := range list {
+		one, ok := policyScalar(e)
+		if !ok {
+			return errPolicyValue
+		}
+
+		many = append(many, one)
+	}
+
+	*s = many
+
+	return nil
+}
+
+// policyStatement is one statement of a bucket policy.  Principal is
+// kept raw because it can be "*" or a map of type to IDs.
+type policyStatement struct {
+	Sid          string                              `json:"Sid,omitempty"`
+	Effect       string                              `json:"Effect"`
+	Principal    json.RawMessage                     `json:"Principal,omitempty"`
+	NotPrincipal json.RawMessage                     `json:"NotPrincipal,omitempty"`
+	Action       stringOrSlice                       `json:"Action,omitempty"`
+	NotAction    stringOrSlice                       `json:"NotAction,omitempty"`
+	Resource     stringOrSlice                       `json:"Resource,omitempty"`
+	NotResource  stringOrSlice                       `json:"NotResource,omitempty"`
+	Condition    map[string]map[string]stringOrSlice `json:"Condition,omitempty"`
+}
+
+// policyDoc is a bucket policy.  Statement can be one object or a list.
+type policyDoc struct {
+	Version   string            `json:"Version,omitempty"`
+	ID        string            `json:"Id,omitempty"`
+	Statement []policyStatement `json:"-"`
+}
+
+// UnmarshalJSON handles the single statement form.
+func (p *policyDoc) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Version   string          `json:"Version"`
+		ID        string          `json:"Id"`
+		Statement json.RawMessage `json:"Statement"`
+	}
+
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	p.Version = raw.Version
+	p.ID = raw.ID
+	p.Statement = nil
+
+	if len(raw.Statement) == 0 {
+		return nil
+	}
+
+	var one policyStatement
+
+	if err := json.Unmarshal(raw.Statement, &one); err == nil {
+		p.Statement = []policyStatement{one}
+
+		return nil
+	}
+
+	return json.Unmarshal(raw.Statement, &p.Statement)
+}
+
+// MarshalJSON always writes Statement as a list.
+func (p policyDoc) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Version   string            `json:"Version,omitempty"`
+		ID        string            `json:"Id,omitempty"`
+		Statement []policyStatement `json:"Statement"`
+	}{p.Version, p.ID, p.Statement})
+}
+
+// getBucketPolicyJSON fetches the bucket policy as is.  A bucket with
+// no policy returns nil, nil.
+func getBucketPolicyJSON(bucket string, svc *s3.S3) ([]byte, error) {
+	count.Incr("aws-get-bucket-policy")
+
+	out, err := svc.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		var aerr awserr.Error
+
+		if errors.As(err, &aerr) && aerr.Code() == errCodeNoPolicy {
+			count.Incr("bucket-policy-none")
+
+			return nil, nil //nolint:nilnil
+		}
+
+		logCountErrTag(err, "GetBucketPolicy failed "+bucket, bucket)
+
+		return nil, err
+	}
+
+	return []byte(aws.StringValue(out.Policy)), nil
+}
+
+// getBucketPolicy fetches and parses the bucket policy.  A bucket with
+// no policy returns nil, nil.
+func getBucketPolicy(bucket string, svc *s3.S3) (*policyDoc, error) {
+	b, err := getBucketPolicyJSON(bucket, svc)
+	if b == nil || err != nil {
+		return nil, err
+	}
+
+	doc := &policyDoc{}
+
+	if err := json.Unmarshal(b, doc); err != nil {
+		count.Incr("bucket-policy-parse-error")
+
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// actionMatches returns true if the statement's Action list covers action.
+// Only handles the * wildcards that show up in practice.
+func (st policyStatement) actionMatches(action string) bool {
+	for _, a := range st.Action {
+		if a == "*" || strings.EqualFold(a, action) {
+			return true
+		}
+
+		if strings.HasSuffix(a, "*") &&
+			strings.HasPrefix(strings.ToLower(action), strings.ToLower(strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// conditionOn returns the condition operators that test key.
+func (st policyStatement) conditionOn(key string) map[string]stringOrSlice {
+	res := make(map[string]stringOrSlice)
+
+	for op, kv := range st.Condition {
+		for k, v := range kv {
+			if strings.EqualFold(k, key) {
+				res[op] = v
+			}
+		}
+	}
+
+	return res
+}
+
+// policyDeniesUnencryptedPut returns true if some statement denies
+// PutObject when the SSE header is missing or not what we want.
+func policyDeniesUnencryptedPut(doc *policyDoc) bool {
+	if doc == nil {
+		return false
+	}
+
+	for _, st := range doc.Statement {
+		if !strings.EqualFold(st.Effect, "Deny") || !st.actionMatches("s3:PutObject") {
+			continue
+		}
+
+		for op, vals := range st.conditionOn(sseHeaderKey) {
+			switch {
+			case strings.EqualFold(op, "Null"):
+				for _, v := range vals {
+					if strings.EqualFold(v, "true") {
+						return true
+					}
+				}
+			case strings.HasPrefix(op, "StringNotEquals"), strings.HasPrefix(op, "StringNotLike"):
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,300 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	severityHigh   = "high"
+	severityMedium = "medium"
+	severityLow    = "low"
+)
+
+// bucketPolicyHeader is the header row of the bucket policy report.
+var bucketPolicyHeader = []string{
+	"account", "bucket", "sid", "finding", "severity", "principal", "detail",
+}
+
+// acctIDRe finds the account in an account ID or IAM ARN principal.
+var acctIDRe = regexp.MustCompile(`(?:^|:)(\d{12})(?::|$)`)
+
+// restrictingConditionKeys are condition keys that keep a "*"
+// principal from meaning the whole internet.
+var restrictingConditionKeys = []string{
+	"aws:PrincipalOrgID", "aws:PrincipalOrgPaths", "aws:PrincipalAccount",
+	"aws:PrincipalArn", "aws:SourceAccount", "aws:SourceArn", "aws:SourceOrgID",
+	"aws:SourceVpc", "aws:SourceVpce", "aws:SourceIp", "aws:userid",
+}
+
+// policyFinding is one problem found in a bucket policy.
+type policyFinding struct {
+	sid       string
+	finding   string
+	severity  string
+	principal string
+	detail    string
+}
+
+// parsePrincipals returns the principals by type ("AWS", "Service",
+// "CanonicalUser", "Federated") and whether "*" is one of them.
+func parsePrincipals(raw json.RawMessage) (map[string][]string, bool) {
+	res := make(map[string][]string)
+
+	if len(raw) == 0 {
+		return res, false
+	}
+
+	var one string
+
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return res, one == "*"
+	}
+
+	var byType map[string]stringOrSlice
+
+	if err := json.Unmarshal(raw, &byType); err != nil {
+		count.Incr("bucket-policy-principal-parse-error")
+
+		return res, false
+	}
+
+	wildcard := false
+
+	for t, ps := range byType {
+		for _, p := range ps {
+			if p == "*" && t == "AWS" {
+				wildcard = true
+			}
+
+			res[t] = append(res[t], p)
+		}
+	}
+
+	return res, wildcard
+}
+
+// hasRestrictingCondition is true if the statement limits who can use
+// it by org, account, source or network.
+func (st policyStatement) hasRestrictingCondition() bool {
+	for _, key := range restrictingConditionKeys {
+		if len(st.conditionOn(key)) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acctTrusted is true for the bucket's account, org accounts and
+// policyTrustedAccounts.
+func acctTrusted(a string, bucketAcct string) bool {
+	if a == bucketAcct {
+		return true
+	}
+
+	if _, ok := theCtx.orgAccts[a]; ok {
+		return true
+	}
+
+	for _, t := range strings.Split(theConfig["policyTrustedAccounts"].StrVal, ",") {
+		if strings.TrimSpace(t) == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPrincipals finds wildcard and outside-the-org principals on an
+// Allow statement.
+func checkPrincipals(st policyStatement, bucketAcct string) []policyFinding {
+	var res []policyFinding
+
+	principals, wildcard := parsePrincipals(st.Principal)
+
+	if wildcard {
+		if st.hasRestrictingCondition() {
+			res = append(res, policyFinding{st.Sid, "wildcard-principal-conditioned", severityLow, "*",
+				"limited by condition " + conditionSummary(st)})
+		} else {
+			res = append(res, policyFinding{st.Sid, "wildcard-principal", severityHigh, "*",
+				"actions " + strings.Join(st.Action, " ")})
+		}
+	}
+
+	for _, p := range principals["AWS"] {
+		if p == "*" {
+			continue
+		}
+
+		m := acctIDRe.FindStringSubmatch(p)
+		if m == nil {
+			res = append(res, policyFinding{st.Sid, "unparsed-principal", severityLow, p, ""})
+
+			continue
+		}
+
+		if !acctTrusted(m[1], bucketAcct) {
+			res = append(res, policyFinding{st.Sid, "external-account", severityHigh, p,
+				"account " + m[1] + " is not in the org"})
+		}
+	}
+
+	for _, p := range principals["CanonicalUser"] {
+		if a := acctForCanonID(p); a == "" || !acctTrusted(a, bucketAcct) {
+			res = append(res, policyFinding{st.Sid, "external-canonical-user", severityMedium, p, ""})
+		}
+	}
+
+	return res
+}
+
+// conditionSummary is a short printable form of a statement's condition.
+func conditionSummary(st policyStatement) string {
+	b, err := json.Marshal(st.Condition)
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
+
+// checkEncryptionConditions finds conditions that let uploads through
+// without KMS encryption.
+func checkEncryptionConditions(st policyStatement) []policyFinding { //nolint:cyclop
+	var res []policyFinding
+
+	conds := st.conditionOn(sseHeaderKey)
+	if len(conds) == 0 || !st.actionMatches("s3:PutObject") {
+		return res
+	}
+
+	isDeny := strings.EqualFold(st.Effect, "Deny")
+
+	for op, vals := range conds {
+		switch {
+		case isDeny && strings.HasSuffix(op, "IfExists"):
+			res = append(res, policyFinding{st.Sid, "weak-encryption-condition", severityMedium, "",
+				op + " lets uploads without the SSE header through"})
+		case isDeny && strings.EqualFold(op, "Null"):
+			for _, v := range vals {
+				if strings.EqualFold(v, "false") {
+					res = append(res, policyFinding{st.Sid, "weak-encryption-condition", severityMedium, "",
+						"Null=false only denies uploads that do send the header"})
+				}
+			}
+		case isDeny && strings.HasPrefix(op, "StringNotEquals"):
+			for _, v := range vals {
+				if v == s3.ServerSideEncryptionAes256 {
+					res = append(res, policyFinding{st.Sid, "weak-encryption-condition", severityLow, "",
+						"deny still allows SSE-S3 (AES256)"})
+				}
+			}
+		case !isDeny && strings.HasPrefix(op, "StringEquals"):
+			for _, v := range vals {
+				if v == s3.ServerSideEncryptionAes256 {
+					res = append(res, policyFinding{st.Sid, "weak-encryption-condition", severityLow, "",
+						"allow grants uploads with SSE-S3 (AES256)"})
+				}
+			}
+		}
+	}
+
+	if isDeny && len(st.NotPrincipal) > 0 {
+		res = append(res, policyFinding{st.Sid, "weak-encryption-condition", severityMedium, string(st.NotPrincipal),
+			"encryption deny exempts NotPrincipal"})
+	}
+
+	return res
+}
+
+// deniesInsecureTransport is true for a Deny on aws:SecureTransport false.
+func (st policyStatement) deniesInsecureTransport() bool {
+	if !strings.EqualFold(st.Effect, "Deny") {
+		return false
+	}
+
+	for op, vals := range st.conditionOn("aws:SecureTransport") {
+		if !strings.HasPrefix(op, "Bool") {
+			continue
+		}
+
+		for _, v := range vals {
+			if strings.EqualFold(v, "false") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// analyzeBucketPolicy returns the findings for one policy.
+func analyzeBucketPolicy(doc *policyDoc, bucketAcct string) []policyFinding {
+	if doc == nil {
+		return []policyFinding{{"", "no-policy", severityLow, "", "no aws:SecureTransport deny"}}
+	}
+
+	var res []policyFinding
+
+	secure := false
+
+	for _, st := range doc.Statement {
+		if st.deniesInsecureTransport() {
+			secure = true
+		}
+
+		if strings.EqualFold(st.Effect, "Allow") {
+			res = append(res, checkPrincipals(st, bucketAcct)...)
+		}
+
+		res = append(res, checkEncryptionConditions(st)...)
+	}
+
+	if !secure {
+		res = append(res, policyFinding{"", "no-secure-transport-deny", severityMedium, "",
+			"no Deny on aws:SecureTransport false"})
+	}
+
+	return res
+}
+
+// checkBucketPolicy fetches one bucket's policy and writes a report
+// row per finding.
+func checkBucketPolicy(acctID string, bucket string, sess *session.Session) {
+	acctID = resolveAcctID(acctID, sess)
+
+	doc, err := getBucketPolicy(bucket, s3.New(sess))
+	if err != nil {
+		writeReportRow(theConfig["bucketPolicyReport"].StrVal, bucketPolicyHeader,
+			[]string{acctID, bucket, "", "policy-error", severityLow, "", err.Error()})
+
+		return
+	}
+
+	findings := analyzeBucketPolicy(doc, acctID)
+
+	for _, f := range findings {
+		count.Incr("policy-finding-" + f.finding)
+		count.Incr("policy-finding-" + f.severity)
+
+		if f.severity == severityHigh {
+			fmt.Println("ERROR: bucket policy", f.finding, acctID, bucket, f.sid, f.principal, f.detail)
+		}
+
+		writeReportRow(theConfig["bucketPolicyReport"].StrVal, bucketPolicyHeader,
+			[]string{acctID, bucket, f.sid, f.finding, f.severity, f.principal, f.detail})
+	}
+
+	log.Println("Bucket policy checked", bucket, len(findings), "findings")
+}
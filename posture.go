@@ -0,0 +1,192 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	errCodeNoEncConfig = "ServerSideEncryptionConfigurationNotFoundError"
+	arnFields          = 6
+	arnAcctField       = 4
+)
+
+// bucketEncPostureHeader is the header row of the posture report.
+var bucketEncPostureHeader = []string{
+	"account", "bucket", "region", "sse_algorithm", "kms_key",
+	"bucket_key_enabled", "policy_denies_unencrypted",
+	"key_arn", "key_state", "key_account", "key_cross_account", "error",
+}
+
+// bucketEncPosture is the default encryption setup of one bucket.
+type bucketEncPosture struct {
+	acctID                  string
+	bucket                  string
+	region                  string
+	algorithm               string // "" means no default config
+	kmsKey                  string
+	keyARN                  string
+	keyState                string
+	bucketKeyEnabled        bool
+	policyDeniesUnencrypted bool
+	keyAcct                 string
+	keyCrossAcct            bool
+	errs                    []string
+}
+
+// row formats the posture for the report.
+func (p bucketEncPosture) row() []string {
+	alg := p.algorithm
+	if alg == "" {
+		alg = "none"
+	}
+
+	return []string{
+		p.acctID, p.bucket, p.region, alg, p.kmsKey,
+		strconv.FormatBool(p.bucketKeyEnabled),
+		strconv.FormatBool(p.policyDeniesUnencrypted),
+		p.keyARN, p.keyState, p.keyAcct, strconv.FormatBool(p.keyCrossAcct),
+		strings.Join(p.errs, "; "),
+	}
+}
+
+// acctFromARN returns the account field of an ARN or "" if s is
+// not an ARN (e.g. a bare key ID or alias).
+func acctFromARN(s string) string {
+	if !strings.HasPrefix(s, "arn:") {
+		return ""
+	}
+
+	f := strings.SplitN(s, ":", arnFields)
+	if len(f) < arnFields {
+		return ""
+	}
+
+	return f[arnAcctField]
+}
+
+// resolveAcctID returns the real account ID; "0" is whatever
+// account the default credentials are in.
+func resolveAcctID(a string, sess *session.Session) string {
+	if a != "0" {
+		return a
+	}
+
+	theCtx.selfAcctOnce.Do(func() {
+		count.Incr("aws-sts-get-caller-identity")
+
+		out, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			logCountErr(err, "GetCallerIdentity failed")
+
+			return
+		}
+
+		theCtx.selfAcct = aws.StringValue(out.Account)
+	})
+
+	return theCtx.selfAcct
+}
+
+// getBucketEncPosture reads the default encryption and bucket policy
+// of a bucket.  It doesn't touch any objects.
+func getBucketEncPosture(acctID string, bucket string, region string, sess *session.Session) bucketEncPosture {
+	svc := s3.New(sess)
+	p := bucketEncPosture{acctID: resolveAcctID(acctID, sess), bucket: bucket, region: region}
+
+	count.Incr("aws-get-bucket-enc-posture")
+
+	out, err := svc.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: aws.String(bucket)})
+
+	var aerr awserr.Error
+
+	switch {
+	case err != nil && errors.As(err, &aerr) && aerr.Code() == errCodeNoEncConfig:
+		count.Incr("bucket-enc-none")
+	case err != nil:
+		logCountErrTag(err, "GetBucketEncryption failed "+bucket, bucket)
+		p.errs = append(p.errs, "encryption: "+err.Error())
+	case out.ServerSideEncryptionConfiguration != nil:
+		for _, r := range out.ServerSideEncryptionConfiguration.Rules {
+			if r.ApplyServerSideEncryptionByDefault == nil {
+				continue
+			}
+
+			p.algorithm = aws.StringValue(r.ApplyServerSideEncryptionByDefault.SSEAlgorithm)
+			p.kmsKey = aws.StringValue(r.ApplyServerSideEncryptionByDefault.KMSMasterKeyID)
+			p.bucketKeyEnabled = aws.BoolValue(r.BucketKeyEnabled)
+		}
+	}
+
+	if p.kmsKey != "" {
+		info := resolveKMSKey(p.kmsKey, p.acctID, region, sess)
+
+		p.keyARN = info.arn
+		p.keyState = info.state
+		p.keyAcct = info.acctID
+		p.keyCrossAcct = p.keyAcct != p.acctID
+	}
+
+	doc, err := getBucketPolicy(bucket, svc)
+	if err != nil {
+		p.errs = append(p.errs, "policy: "+err.Error())
+	}
+
+	p.policyDeniesUnencrypted = policyDeniesUnencryptedPut(doc)
+
+	return p
+}
+
+// checkBucketEncPosture writes one posture row for the bucket and
+// counts the interesting cases.
+func checkBucketEncPosture(acctID string, bucket string, region string, sess *session.Session) {
+	p := getBucketEncPosture(acctID, bucket, region, sess)
+
+	switch p.algorithm {
+	case "":
+		count.Incr("posture-no-default-enc")
+		fmt.Println("ERROR: no default encryption", bucket)
+	case s3.ServerSideEncryptionAes256:
+		count.Incr("posture-sse-s3")
+	default:
+		count.Incr("posture-sse-kms")
+
+		if !p.bucketKeyEnabled {
+			count.Incr("posture-no-bucket-key")
+		}
+	}
+
+	if !p.policyDeniesUnencrypted {
+		count.Incr("posture-no-deny-unencrypted")
+	}
+
+	if p.keyState != "" && p.keyState != kms.KeyStateEnabled {
+		count.Incr("posture-key-not-enabled")
+		fmt.Println("ERROR: default kms key not enabled", bucket, p.keyARN, p.keyState)
+	}
+
+	if p.keyCrossAcct {
+		count.Incr("posture-key-cross-account")
+		fmt.Println("Cross account key", bucket, p.kmsKey)
+	}
+
+	if len(p.errs) > 0 {
+		count.Incr("posture-error")
+	}
+
+	log.Println("Bucket encryption posture", p.row())
+	writeReportRow(theConfig["bucketPostureReport"].StrVal, bucketEncPostureHeader, p.row())
+}
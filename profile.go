@@ -0,0 +1,411 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	typeInt    = "int"
+	typeFloat  = "float"
+	typeDate   = "date"
+	typeBool   = "bool"
+	typeString = "string"
+	typeEmpty  = "empty" // every value was null
+	topKSlack  = 10      // the summary tracks this many times the values reported
+)
+
+// valueTypes are the inferred types, most specific first.
+var valueTypes = []string{typeBool, typeInt, typeFloat, typeDate, typeString}
+
+// dateLayouts are the formats a value can have to count as a date.
+var dateLayouts = []string{
+	"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "01/02/2006", "20060102",
+}
+
+// profileHeader is the header row of both profile reports; key is
+// empty in the bucket report.
+var profileHeader = []string{
+	"bucket", "key", "files", "column", "name", "rows", "nulls", "null_pct", "distinct_est",
+	"min_len", "max_len", "type", "type_counts", "top_values", "bad_values",
+}
+
+// columnProfile is what we know about one column.
+type columnProfile struct {
+	index      int
+	name       string
+	rows       int64
+	nulls      int64
+	minLen     int
+	maxLen     int
+	types      map[string]int64
+	typeSample map[string][]string // first few values of each type, for bad values
+	distinct   *hll
+	top        *topK
+}
+
+// tableProfile is the columns of one file, or of a bucket's files
+// merged by column name.
+type tableProfile struct {
+	files   int
+	columns []*columnProfile
+	byName  map[string]*columnProfile
+}
+
+// newTableProfile makes an empty profile.
+func newTableProfile() *tableProfile {
+	return &tableProfile{byName: make(map[string]*columnProfile)}
+}
+
+// column returns the named column, adding it if it is new.
+func (t *tableProfile) column(name string) *columnProfile {
+	if c, ok := t.byName[name]; ok {
+		return c
+	}
+
+	c := &columnProfile{
+		index:      len(t.columns),
+		name:       name,
+		minLen:     -1,
+		types:      make(map[string]int64),
+		typeSample: make(map[string][]string),
+		distinct:   &hll{},
+		top:        newTopK(theConfig["profileTopK"].IntVal * topKSlack),
+	}
+
+	t.columns = append(t.columns, c)
+	t.byName[name] = c
+
+	return c
+}
+
+// isNullValue is the null test shared with countNulls.
+func isNullValue(val string) bool {
+	return val == "" || strings.EqualFold(val, "NULL") || val == "\\N"
+}
+
+// inferType returns the most specific type the value parses as.
+func inferType(val string) string {
+	switch strings.ToLower(val) {
+	case "true", "false", "t", "f", "yes", "no":
+		return typeBool
+	}
+
+	if _, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return typeInt
+	}
+
+	if _, err := strconv.ParseFloat(val, 64); err == nil {
+		return typeFloat
+	}
+
+	for _, l := range dateLayouts {
+		if _, err := time.Parse(l, val); err == nil {
+			return typeDate
+		}
+	}
+
+	return typeString
+}
+
+// add profiles one value.
+func (c *columnProfile) add(val string) {
+	c.rows++
+
+	if isNullValue(val) {
+		c.nulls++
+
+		return
+	}
+
+	if c.minLen < 0 || len(val) < c.minLen {
+		c.minLen = len(val)
+	}
+
+	if len(val) > c.maxLen {
+		c.maxLen = len(val)
+	}
+
+	t := inferType(val)
+	c.types[t]++
+
+	if len(c.typeSample[t]) < theConfig["profileBadSamples"].IntVal {
+		c.typeSample[t] = append(c.typeSample[t], val)
+	}
+
+	c.distinct.add(val)
+	c.top.add(val)
+}
+
+// merge folds o into c.
+func (c *columnProfile) merge(o *columnProfile) {
+	c.rows += o.rows
+	c.nulls += o.nulls
+
+	if o.minLen >= 0 && (c.minLen < 0 || o.minLen < c.minLen) {
+		c.minLen = o.minLen
+	}
+
+	if o.maxLen > c.maxLen {
+		c.maxLen = o.maxLen
+	}
+
+	for t, n := range o.types {
+		c.types[t] += n
+
+		for _, v := range o.typeSample[t] {
+			if len(c.typeSample[t]) < theConfig["profileBadSamples"].IntVal {
+				c.typeSample[t] = append(c.typeSample[t], v)
+			}
+		}
+	}
+
+	c.distinct.merge(o.distinct)
+	c.top.merge(o.top)
+}
+
+// inferredType is the column's type: int if every value is an int,
+// float if every value is a number, and so on.  Values of another type
+// than the winner are the bad values.  A column mostly of one type
+// with a few strings mixed in is still that type, so the strings show
+// up as bad.
+func (c *columnProfile) inferredType() string {
+	nonNull := c.rows - c.nulls
+	if nonNull == 0 {
+		return typeEmpty
+	}
+
+	if c.types[typeInt]+c.types[typeFloat] == nonNull {
+		if c.types[typeFloat] == 0 {
+			return typeInt
+		}
+
+		return typeFloat
+	}
+
+	best := typeString
+
+	for _, t := range valueTypes {
+		if c.types[t] > c.types[best] {
+			best = t
+		}
+	}
+
+	return best
+}
+
+// badValues are sample values not of the column's type.
+func (c *columnProfile) badValues(typ string) []string {
+	var res []string
+
+	for _, t := range valueTypes {
+		if t == typ || (typ == typeFloat && t == typeInt) || typ == typeString {
+			continue
+		}
+
+		res = append(res, c.typeSample[t]...)
+	}
+
+	if len(res) > theConfig["profileBadSamples"].IntVal {
+		res = res[:theConfig["profileBadSamples"].IntVal]
+	}
+
+	return res
+}
+
+// row is the report row for the column.
+func (c *columnProfile) row(bucket string, key string, files int) []string {
+	typ := c.inferredType()
+
+	pct := 0.0
+	if c.rows > 0 {
+		pct = float64(c.nulls) * perCent / float64(c.rows)
+	}
+
+	typeCounts := make([]string, 0, len(c.types))
+
+	for _, t := range valueTypes {
+		if n := c.types[t]; n > 0 {
+			typeCounts = append(typeCounts, t+"="+strconv.FormatInt(n, 10))
+		}
+	}
+
+	top := make([]string, 0, theConfig["profileTopK"].IntVal)
+	for _, vc := range c.top.top(theConfig["profileTopK"].IntVal) {
+		top = append(top, vc.value+"="+strconv.FormatInt(vc.count, 10))
+	}
+
+	return []string{
+		bucket, key, strconv.Itoa(files), strconv.Itoa(c.index), c.name,
+		strconv.FormatInt(c.rows, 10), strconv.FormatInt(c.nulls, 10), strconv.FormatFloat(pct, 'f', 2, 64),
+		strconv.FormatInt(c.distinct.estimate(), 10), strconv.Itoa(max(c.minLen, 0)), strconv.Itoa(c.maxLen),
+		typ, strings.Join(typeCounts, " "), strings.Join(top, " "), strings.Join(c.badValues(typ), " "),
+	}
+}
+
+// writeProfile writes one report row per column.
+func writeProfile(filename string, bucket string, key string, t *tableProfile) {
+	for _, c := range t.columns {
+		writeReportRow(filename, profileHeader, c.row(bucket, key, t.files))
+	}
+}
+
+// keyHasSuffix is true if the key ends in one of the comma separated
+// suffixes, or there are none.
+func keyHasSuffix(key string, suffixes string) bool {
+	suffixes = strings.TrimSpace(suffixes)
+	if suffixes == "" {
+		return true
+	}
+
+	for _, s := range strings.Split(suffixes, ",") {
+		if s = strings.TrimSpace(s); s != "" && strings.HasSuffix(key, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// profileObject streams one object, profiles every column, writes the
+// per file report and merges the profile into its bucket's.
+func profileObject(bucket string, key string, sess *session.Session) { //nolint:cyclop
+	if !keyHasSuffix(key, theConfig["profileKeySuffixes"].StrVal) {
+		count.Incr("profile-skip-key")
+
+		return
+	}
+
+	if f := columnarFormat(key); f != "" {
+		t, err := profileColumnar(bucket, key, f, sess)
+		if err != nil {
+			logCountErrTag(err, "columnar profile failed "+bucket+"/"+key, bucket)
+
+			return
+		}
+
+		addFileProfile(bucket, key, t)
+
+		return
+	}
+
+	svc := s3.New(sess)
+
+	count.Incr("aws-get-object")
+
+	resp, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		logCountErrTag(err, "GetObject failed "+bucket+"/"+key, bucket)
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	body, done, err := decodedBody(bucket, key, resp)
+	if err != nil {
+		log.Println("Error decompressing object", bucket, key, err)
+		count.Incr("profile-decompress-error")
+
+		return
+	}
+
+	defer done()
+
+	d := dialectFor("profileDelimiter", theConfig["profileHasHeader"].BoolVal, key)
+	rr := newRecordReader(body, d)
+	t := newTableProfile()
+
+	var names []string
+
+	for {
+		rec, err := rr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil && !countMalformed(err, "profile", bucket, key) {
+			log.Println("Error scanning object", bucket, key, err)
+			count.Incr("profile-scan-error")
+
+			return
+		}
+
+		if d.hasHeader && names == nil {
+			names = make([]string, len(rec.fields))
+			for i, f := range rec.fields {
+				names[i] = strings.TrimSpace(f)
+			}
+
+			continue
+		}
+
+		count.Incr("profile-row")
+		count.Incr("profile-row-" + bucket)
+
+		for i, val := range rec.fields {
+			name := "col_" + strconv.Itoa(i)
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+
+			t.column(name).add(val)
+		}
+	}
+
+	addFileProfile(bucket, key, t)
+}
+
+// addFileProfile writes one file's profile and merges it into its
+// bucket's.
+func addFileProfile(bucket string, key string, t *tableProfile) {
+	t.files = 1
+
+	count.Incr("profile-file")
+	fmt.Println("Profiled", len(t.columns), "columns in", bucket, path.Base(key))
+	writeProfile(theConfig["profileFileReport"].StrVal, bucket, key, t)
+
+	theCtx.profilesRW.Lock()
+	defer theCtx.profilesRW.Unlock()
+
+	bp, ok := theCtx.profiles[bucket]
+	if !ok {
+		bp = newTableProfile()
+		theCtx.profiles[bucket] = bp
+	}
+
+	bp.files++
+
+	for _, c := range t.columns {
+		bp.column(c.name).merge(c)
+	}
+}
+
+// finishBucketProfile writes the bucket report once all its objects
+// are profiled.
+func finishBucketProfile(bucket string) {
+	theCtx.profilesRW.Lock()
+	bp, ok := theCtx.profiles[bucket]
+	delete(theCtx.profiles, bucket)
+	theCtx.profilesRW.Unlock()
+
+	if !ok {
+		return
+	}
+
+	log.Println("Bucket profile", bucket, bp.files, "files", len(bp.columns), "columns")
+	writeProfile(theConfig["profileBucketReport"].StrVal, bucket, "", bp)
+}
@@ -0,0 +1,460 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	stateQueued  = "queued"
+	stateRunning = "running"
+	stateListed  = "listed" // listing done, objects still being handled
+	stateDone    = "done"
+
+	storageMetricsLookback = 3 * 24 * time.Hour // daily metrics, a day or two late
+	storageMetricsPeriod   = 86400
+)
+
+// bucketProgress is what's known about one bucket's progress.
+// expObjects and expBytes are from CloudWatch's daily storage metrics,
+// 0 if unknown; once the listing is done the listed count is used.
+type bucketProgress struct {
+	acct       string
+	state      string
+	start      time.Time
+	end        time.Time
+	listed     int64
+	objects    int64
+	bytes      int64
+	expObjects int64
+	expBytes   int64
+}
+
+// bucketStatus is one bucket in /status.
+type bucketStatus struct {
+	Bucket          string  `json:"bucket"`
+	Account         string  `json:"account"`
+	State           string  `json:"state"`
+	Objects         int64   `json:"objects"`
+	Bytes           int64   `json:"bytes"`
+	Listed          int64   `json:"listed"`
+	ExpectedObjects int64   `json:"expected_objects"`
+	ExpectedBytes   int64   `json:"expected_bytes"`
+	ObjectsPerSec   float64 `json:"objects_per_second"`
+	BytesPerSec     float64 `json:"bytes_per_second"`
+	ETASeconds      float64 `json:"eta_seconds"` // -1 if unknown
+}
+
+// accountStatus is one account in /status.  The remaining counts are
+// summed over the buckets not done whose size is known, and the ETA is
+// the slower of them at the account's rate since its first bucket
+// started.
+type accountStatus struct {
+	Account          string    `json:"account"`
+	Queued           int       `json:"buckets_queued"`
+	Running          int       `json:"buckets_running"`
+	Done             int       `json:"buckets_done"`
+	Objects          int64     `json:"objects"`
+	Bytes            int64     `json:"bytes"`
+	RemainingObjects int64     `json:"remaining_objects"`
+	RemainingBytes   int64     `json:"remaining_bytes"`
+	ETASeconds       float64   `json:"eta_seconds"` // -1 if unknown
+	start            time.Time // of its first bucket
+}
+
+// runStatus is the /status document.
+type runStatus struct {
+	ElapsedSeconds  float64          `json:"elapsed_seconds"`
+	Objects         int64            `json:"objects"`
+	Bytes           int64            `json:"bytes"`
+	ExpectedObjects int64            `json:"expected_objects"`
+	ObjectsPerSec   float64          `json:"objects_per_second"`
+	BytesPerSec     float64          `json:"bytes_per_second"`
+	ETASeconds      float64          `json:"eta_seconds"` // of the buckets started so far, -1 if unknown
+	Channels        map[string]int   `json:"channel_depth"`
+	Accounts        []*accountStatus `json:"accounts"`
+	Buckets         []bucketStatus   `json:"buckets"`
+}
+
+// progressQueued notes a bucket sent to handleBucket.
+func progressQueued(acct string, bucket string) {
+	theCtx.progressRW.Lock()
+	defer theCtx.progressRW.Unlock()
+
+	theCtx.progress[bucket] = &bucketProgress{acct: acct, state: stateQueued}
+}
+
+// progressGet returns the bucket's progress, making it if the bucket
+// didn't come through progressQueued.  Must hold progressRW.
+func progressGet(bucket string) *bucketProgress {
+	p, ok := theCtx.progress[bucket]
+	if !ok {
+		p = &bucketProgress{state: stateQueued}
+		theCtx.progress[bucket] = p
+	}
+
+	return p
+}
+
+// progressStart notes handleBucket picking the bucket up.
+func progressStart(bucket string) {
+	theCtx.progressRW.Lock()
+	defer theCtx.progressRW.Unlock()
+
+	p := progressGet(bucket)
+	p.state = stateRunning
+	p.start = time.Now()
+}
+
+// progressObjectListed counts an object queued from the listing.
+func progressObjectListed(bucket string) {
+	theCtx.progressRW.Lock()
+	progressGet(bucket).listed++
+	theCtx.progressRW.Unlock()
+}
+
+// progressListed notes the listing is finished, and marks the bucket
+// done once its objects are.
+func progressListed(bucket string, wg interface{ Wait() }) {
+	theCtx.progressRW.Lock()
+	progressGet(bucket).state = stateListed
+	theCtx.progressRW.Unlock()
+
+	go func() {
+		wg.Wait()
+		progressDone(bucket)
+	}()
+}
+
+// progressDone notes the bucket is finished.
+func progressDone(bucket string) {
+	theCtx.progressRW.Lock()
+	defer theCtx.progressRW.Unlock()
+
+	p := progressGet(bucket)
+	p.state = stateDone
+	p.end = time.Now()
+}
+
+// progressObject counts an object handled, and its size.
+func progressObject(bucket string, size int64) {
+	theCtx.progressRW.Lock()
+	defer theCtx.progressRW.Unlock()
+
+	p := progressGet(bucket)
+	p.objects++
+	p.bytes += size
+}
+
+// latestStorageMetric is the newest daily value of an AWS/S3 storage
+// metric for the bucket and storage type.
+func latestStorageMetric(svc *cloudwatch.CloudWatch, bucket string, metric string, storageType string) (int64, error) {
+	count.Incr("aws-cloudwatch-get-metric-statistics")
+
+	now := time.Now()
+
+	out, err := svc.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/S3"),
+		MetricName: aws.String(metric),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("BucketName"), Value: aws.String(bucket)},
+			{Name: aws.String("StorageType"), Value: aws.String(storageType)},
+		},
+		StartTime:  aws.Time(now.Add(-storageMetricsLookback)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(storageMetricsPeriod),
+		Statistics: []*string{aws.String(cloudwatch.StatisticAverage)},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var latest *cloudwatch.Datapoint
+
+	for _, d := range out.Datapoints {
+		if latest == nil || d.Timestamp.After(*latest.Timestamp) {
+			latest = d
+		}
+	}
+
+	if latest == nil {
+		return 0, nil
+	}
+
+	return int64(aws.Float64Value(latest.Average)), nil
+}
+
+// progressExpect looks up the bucket's object count and size in
+// CloudWatch.  Sizes are per storage class, so every class the bucket
+// has a metric for is added up.  These are for the whole bucket, so
+// they are skipped when listFilesMatchingPrefix narrows the listing.
+func progressExpect(bucket string, sess *session.Session) {
+	if !theConfig["progressCloudWatch"].BoolVal {
+		return
+	}
+
+	prefix := theConfig["listFilesMatchingPrefix"].StrVal
+	if prefix != "" && prefix != "%%%" && prefix != "*" {
+		count.Incr("progress-cloudwatch-skip-prefix")
+
+		return
+	}
+
+	svc := cloudwatch.New(sess)
+
+	objects, err := latestStorageMetric(svc, bucket, "NumberOfObjects", "AllStorageTypes")
+	if err != nil {
+		logCountErrTag(err, "CloudWatch NumberOfObjects failed "+bucket, bucket)
+
+		return
+	}
+
+	count.Incr("aws-cloudwatch-list-metrics")
+
+	var size int64
+
+	err = svc.ListMetricsPages(&cloudwatch.ListMetricsInput{
+		Namespace:  aws.String("AWS/S3"),
+		MetricName: aws.String("BucketSizeBytes"),
+		Dimensions: []*cloudwatch.DimensionFilter{{Name: aws.String("BucketName"), Value: aws.String(bucket)}},
+	}, func(out *cloudwatch.ListMetricsOutput, _ bool) bool {
+		for _, m := range out.Metrics {
+			for _, d := range m.Dimensions {
+				if aws.StringValue(d.Name) != "StorageType" {
+					continue
+				}
+
+				n, err := latestStorageMetric(svc, bucket, "BucketSizeBytes", aws.StringValue(d.Value))
+				if err != nil {
+					logCountErrTag(err, "CloudWatch BucketSizeBytes failed "+bucket, bucket)
+
+					continue
+				}
+
+				size += n
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		logCountErrTag(err, "CloudWatch ListMetrics failed "+bucket, bucket)
+	}
+
+	theCtx.progressRW.Lock()
+	defer theCtx.progressRW.Unlock()
+
+	p := progressGet(bucket)
+	p.expObjects = objects
+	p.expBytes = size
+}
+
+// eta is how long the remaining work takes at rate, -1 if unknown.
+func eta(remaining int64, rate float64) float64 {
+	if remaining < 0 || rate <= 0 {
+		return -1
+	}
+
+	return float64(remaining) / rate
+}
+
+// accountETA estimates how long the account's remaining objects and
+// bytes will take at its rate so far.
+func accountETA(a *accountStatus, now time.Time) float64 {
+	if a.Queued == 0 && a.Running == 0 {
+		return 0
+	}
+
+	secs := now.Sub(a.start).Seconds()
+	if a.start.IsZero() || secs <= 0 || (a.RemainingObjects == 0 && a.RemainingBytes == 0) {
+		return -1
+	}
+
+	res := eta(a.RemainingObjects, float64(a.Objects)/secs)
+	if a.RemainingBytes > 0 {
+		res = max(res, eta(a.RemainingBytes, float64(a.Bytes)/secs))
+	}
+
+	return res
+}
+
+// status builds the /status document.
+func status() runStatus { //nolint:cyclop
+	now := time.Now()
+	rs := runStatus{
+		ElapsedSeconds: now.Sub(theCtx.progressStart).Seconds(),
+		Channels: map[string]int{
+			"account": len(theCtx.accountChan),
+			"bucket":  len(theCtx.bucketChan),
+			"object":  len(theCtx.objectChan),
+		},
+	}
+	accts := make(map[string]*accountStatus)
+
+	var remaining int64
+
+	theCtx.progressRW.Lock()
+
+	for b, p := range theCtx.progress {
+		a, ok := accts[p.acct]
+		if !ok {
+			a = &accountStatus{Account: p.acct}
+			accts[p.acct] = a
+			rs.Accounts = append(rs.Accounts, a)
+		}
+
+		a.Objects += p.objects
+		a.Bytes += p.bytes
+		rs.Objects += p.objects
+		rs.Bytes += p.bytes
+
+		bs := bucketStatus{
+			Bucket: b, Account: p.acct, State: p.state, Objects: p.objects, Bytes: p.bytes,
+			Listed: p.listed, ExpectedObjects: p.expObjects, ExpectedBytes: p.expBytes, ETASeconds: -1,
+		}
+
+		if p.state == stateListed || p.state == stateDone {
+			bs.ExpectedObjects = p.listed
+		}
+
+		switch p.state {
+		case stateQueued:
+			a.Queued++
+		case stateDone:
+			a.Done++
+			bs.ETASeconds = 0
+		default:
+			a.Running++
+		}
+
+		if !p.start.IsZero() {
+			end := now
+			if p.state == stateDone {
+				end = p.end
+			}
+
+			if secs := end.Sub(p.start).Seconds(); secs > 0 {
+				bs.ObjectsPerSec = float64(p.objects) / secs
+				bs.BytesPerSec = float64(p.bytes) / secs
+			}
+		}
+
+		if p.state != stateQueued && p.state != stateDone && bs.ExpectedObjects > 0 {
+			left := max(bs.ExpectedObjects-p.objects, 0)
+			bs.ETASeconds = eta(left, bs.ObjectsPerSec)
+			remaining += left
+		}
+
+		if p.state != stateDone {
+			if bs.ExpectedObjects > 0 {
+				a.RemainingObjects += max(bs.ExpectedObjects-p.objects, 0)
+			}
+
+			if p.expBytes > 0 {
+				a.RemainingBytes += max(p.expBytes-p.bytes, 0)
+			}
+		}
+
+		if !p.start.IsZero() && (a.start.IsZero() || p.start.Before(a.start)) {
+			a.start = p.start
+		}
+
+		rs.ExpectedObjects += bs.ExpectedObjects
+		rs.Buckets = append(rs.Buckets, bs)
+	}
+
+	theCtx.progressRW.Unlock()
+
+	for _, a := range rs.Accounts {
+		a.ETASeconds = accountETA(a, now)
+	}
+
+	if rs.ElapsedSeconds > 0 {
+		rs.ObjectsPerSec = float64(rs.Objects) / rs.ElapsedSeconds
+		rs.BytesPerSec = float64(rs.Bytes) / rs.ElapsedSeconds
+	}
+
+	rs.ETASeconds = eta(remaining, rs.ObjectsPerSec)
+
+	sort.Slice(rs.Buckets, func(i, j int) bool { return rs.Buckets[i].Bucket < rs.Buckets[j].Bucket })
+	sort.Slice(rs.Accounts, func(i, j int) bool { return rs.Accounts[i].Account < rs.Accounts[j].Account })
+
+	return rs
+}
+
+// serveStatus is /status.
+func serveStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(status()); err != nil {
+		log.Println("Error writing status", err)
+	}
+}
+
+// fmtETA prints an ETA in seconds, "?" if unknown.
+func fmtETA(secs float64) string {
+	if secs < 0 {
+		return "?"
+	}
+
+	return time.Duration(secs * float64(time.Second)).Round(time.Second).String()
+}
+
+// logProgress prints the status line, and a line per running bucket.
+func logProgress() {
+	rs := status()
+
+	var queued, running, done int
+
+	for _, a := range rs.Accounts {
+		queued += a.Queued
+		running += a.Running
+		done += a.Done
+	}
+
+	log.Printf("Progress: %d accounts, buckets %d queued %d running %d done, "+
+		"%d objects (%.1f/s) %d bytes (%.0f/s), ETA %s\n",
+		len(rs.Accounts), queued, running, done, rs.Objects, rs.ObjectsPerSec, rs.Bytes, rs.BytesPerSec,
+		fmtETA(rs.ETASeconds))
+
+	for _, b := range rs.Buckets {
+		if b.State != stateRunning && b.State != stateListed {
+			continue
+		}
+
+		expected := "?"
+		if b.ExpectedObjects > 0 {
+			expected = fmt.Sprint(b.ExpectedObjects)
+		}
+
+		log.Printf("Progress: %s %s %d of %s objects (%.1f/s), ETA %s\n",
+			b.Bucket, b.State, b.Objects, expected, b.ObjectsPerSec, fmtETA(b.ETASeconds))
+	}
+}
+
+// progressLoop logs the progress every progressInterval seconds.
+func progressLoop() {
+	secs := theConfig["progressInterval"].IntVal
+	if secs <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(time.Duration(secs) * time.Second)
+		logProgress()
+	}
+}
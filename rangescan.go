@@ -0,0 +1,238 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+// minRangeParts is the fewest ranges worth scanning at once.
+const minRangeParts = 2
+
+// objectSize is the HeadObject length, 0 if there was no head.
+func objectSize(head *s3.HeadObjectOutput) int64 {
+	if head == nil {
+		return 0
+	}
+
+	return aws.Int64Value(head.ContentLength)
+}
+
+// rangeParts is how many byte ranges an object of size is split into.
+func rangeParts(size int64) int {
+	part := max(int64(theConfig["rangeScanPartBytes"].IntVal), 1)
+
+	return int((size + part - 1) / part)
+}
+
+// rangeScannable is true for objects at least rangeScanMinBytes big
+// that aren't compressed; a compressed stream can't be entered in the
+// middle.
+func rangeScannable(key string, head *s3.HeadObjectOutput) bool {
+	minBytes := int64(theConfig["rangeScanMinBytes"].IntVal)
+	if minBytes <= 0 || objectSize(head) < minBytes || rangeParts(objectSize(head)) < minRangeParts {
+		return false
+	}
+
+	if !theConfig["decompress"].BoolVal {
+		return true
+	}
+
+	return codecFromEncoding(aws.StringValue(head.ContentEncoding)) == "" && codecFromKey(key) == ""
+}
+
+// rangeReader reads an object from pos on with bounded range GETs:
+// the first through first, later ones step bytes long, up to size.
+type rangeReader struct {
+	svc    *s3.S3
+	bucket string
+	key    string
+	pos    int64
+	first  int64
+	step   int64
+	size   int64
+	body   io.ReadCloser
+}
+
+// Read reads from the current range, fetching the next when it's done.
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.body != nil {
+			n, err := r.body.Read(p)
+			r.pos += int64(n)
+
+			if errors.Is(err, io.EOF) {
+				r.body.Close()
+				r.body = nil
+				err = nil
+			}
+
+			if n > 0 || err != nil {
+				return n, err
+			}
+		}
+
+		if r.pos >= r.size {
+			return 0, io.EOF
+		}
+
+		last := min(r.pos+r.step, r.size) - 1
+		if r.first > r.pos {
+			last = min(r.first, r.size) - 1
+		}
+
+		count.Incr("aws-get-object-range-scan")
+
+		resp, err := r.svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(r.bucket),
+			Key:    aws.String(r.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", r.pos, last)),
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		r.body = resp.Body
+	}
+}
+
+// Close closes the current range's body.
+func (r *rangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	return r.body.Close()
+}
+
+// scanRanges splits the object into rangeParts byte ranges and reads
+// them at once, at most rangeScanConcurrency across all objects.  A
+// row belongs to the range its first byte is in: each range after the
+// first skips the partial row it starts in, and every range reads on
+// past its end to finish its last row.  This assumes line breaks only
+// end rows; a quoted field with a line break across a range boundary
+// shows up as malformed rows.
+//
+// Each range is fetched through rangeScanOverlapBytes past its end,
+// and on in more pieces that size if its last row is longer.
+//
+// header is called with the first row if the dialect has one, before
+// any row is passed to row; the other ranges don't start until then.
+// row is called at once from many go routines with the range number,
+// the record and its byte offset.
+func scanRanges(bucket string, key string, head *s3.HeadObjectOutput, d dialect, prefix string,
+	header func(fields []string), row func(part int, rec *record, offset int64), sess *session.Session,
+) error {
+	size := objectSize(head)
+	partSize := int64(theConfig["rangeScanPartBytes"].IntVal)
+	overlap := max(int64(theConfig["rangeScanOverlapBytes"].IntVal), 1)
+	parts := rangeParts(size)
+	svc := s3.New(sess)
+	headerDone := make(chan struct{})
+	closeHeader := sync.OnceFunc(func() { close(headerDone) })
+	errs := make([]error, parts)
+	wg := new(sync.WaitGroup)
+
+	count.Incr(prefix + "-range-scan")
+	count.IncrDelta(prefix+"-range-parts", int64(parts))
+	fmt.Println("Scanning", bucket, key, "in", parts, "ranges")
+
+	scanRange := func(i int) error { //nolint:cyclop
+		start := int64(i) * partSize
+		end := min(start+partSize, size)
+		from := start
+
+		if i > 0 {
+			from = start - 1 // to see if a row starts right at start
+		}
+
+		body := &rangeReader{
+			svc: svc, bucket: bucket, key: key,
+			pos: from, first: end + overlap, step: overlap, size: size,
+		}
+		defer body.Close()
+
+		br := bufio.NewReaderSize(body, scannerBufSize)
+		base := from
+
+		if i > 0 {
+			skipped, err := br.ReadBytes(d.lineTerm)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			base += int64(len(skipped))
+		}
+
+		rr := newRecordReader(br, d)
+
+		for {
+			rec, err := rr.Read()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			if err != nil && !countMalformed(err, prefix, bucket, key) {
+				return err
+			}
+
+			offset := base + rec.offset
+			if offset >= end {
+				return nil
+			}
+
+			if i == 0 && d.hasHeader && offset == 0 {
+				header(rec.fields)
+				closeHeader()
+
+				continue
+			}
+
+			row(i, rec, offset)
+		}
+	}
+
+	if !d.hasHeader {
+		closeHeader()
+	}
+
+	for i := range parts {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// wait for the header before taking a slot, else ranges
+			// after the first could hold every slot while range 0
+			// waits for one
+			if i > 0 {
+				<-headerDone
+			}
+
+			theCtx.rangeSem <- struct{}{}
+			defer func() { <-theCtx.rangeSem }()
+
+			errs[i] = scanRange(i)
+			if i == 0 {
+				closeHeader() // even if range 0 failed, let the others go
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
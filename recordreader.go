@@ -0,0 +1,386 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	headerRuleFields = 2
+)
+
+// dialect is how a delimited file is laid out.  quote 0 means no
+// quoting; escape 0, or the quote itself, means a quote in a quoted
+// field is doubled (RFC 4180).
+type dialect struct {
+	delim     byte
+	quote     byte
+	escape    byte
+	lineTerm  byte // '\n' (a \r before it is dropped) or '\r'
+	crlf      bool // lines end in \r\n
+	hasHeader bool
+	maxRecord int // bytes, 0 for no limit
+}
+
+// record is one row.  line and offset are where it starts; raw is its
+// text without the line terminator and term the terminator as it was
+// in the file, "" for a last row without one.
+type record struct {
+	fields []string
+	line   int
+	offset int64
+	raw    string
+	term   string
+}
+
+// malformedError is a row that didn't parse cleanly; the record is
+// still returned as best we could split it.
+type malformedError struct {
+	line   int
+	offset int64
+	msg    string
+}
+
+func (e *malformedError) Error() string {
+	return fmt.Sprintf("malformed row at line %d (byte %d): %s", e.line, e.offset, e.msg)
+}
+
+// errRecordTooLong stops a read at a row longer than maxRecordBytes,
+// usually a quote that never closes.
+var errRecordTooLong = errors.New("row longer than maxRecordBytes")
+
+// recordReader splits a stream into records following a dialect.
+// Quoted fields can hold delimiters and line breaks, and rows can be
+// any length up to the dialect's maxRecord.
+type recordReader struct {
+	r      *bufio.Reader
+	d      dialect
+	line   int
+	offset int64
+	raw    strings.Builder
+}
+
+// newRecordReader wraps r.
+func newRecordReader(r io.Reader, d dialect) *recordReader {
+	return &recordReader{r: bufio.NewReaderSize(r, scannerBufSize), d: d, line: 1}
+}
+
+// next reads one byte, keeping the raw text and position.
+func (rr *recordReader) next() (byte, error) {
+	c, err := rr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	rr.offset++
+
+	rr.raw.WriteByte(c)
+
+	return c, nil
+}
+
+// crBeforeLF is true for the CR of a CRLF when records end in LF.
+func (rr *recordReader) crBeforeLF(c byte) bool {
+	if c != '\r' || rr.d.lineTerm != '\n' {
+		return false
+	}
+
+	p, err := rr.r.Peek(1)
+
+	return err == nil && p[0] == '\n'
+}
+
+// Read returns the next record, io.EOF at the end, or the record and
+// a *malformedError for a row that didn't parse cleanly.
+func (rr *recordReader) Read() (*record, error) { //nolint:cyclop,gocognit
+	rec := &record{line: rr.line, offset: rr.offset}
+
+	rr.raw.Reset()
+
+	var (
+		field    strings.Builder
+		inQuotes bool
+		wasQuote bool // field started with a quote
+		afterEnd bool // closing quote seen, waiting for delimiter
+		bad      string
+		sawAny   bool
+	)
+
+	for {
+		c, err := rr.next()
+		if errors.Is(err, io.EOF) {
+			if !sawAny {
+				return nil, io.EOF
+			}
+
+			if inQuotes {
+				bad = "unterminated quoted field"
+			}
+
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		sawAny = true
+
+		if c == '\n' {
+			rr.line++
+		}
+
+		if rr.d.maxRecord > 0 && rr.raw.Len() > rr.d.maxRecord {
+			// not malformed: there's no whole row to hand back
+			return nil, fmt.Errorf("%w (%d) at line %d byte %d", errRecordTooLong, rr.d.maxRecord, rec.line, rec.offset)
+		}
+
+		switch {
+		case rr.d.escape != 0 && rr.d.escape != rr.d.quote && c == rr.d.escape:
+			n, err := rr.next()
+			if err != nil {
+				bad = "escape at end of file"
+
+				continue
+			}
+
+			if n == '\n' {
+				rr.line++
+			}
+
+			field.WriteByte(n)
+		case inQuotes && c == rr.d.quote:
+			p, err := rr.r.Peek(1)
+			if (rr.d.escape == 0 || rr.d.escape == rr.d.quote) && err == nil && p[0] == rr.d.quote {
+				_, _ = rr.next()
+
+				field.WriteByte(c) // doubled quote
+			} else {
+				inQuotes = false
+				afterEnd = true
+			}
+		case inQuotes:
+			field.WriteByte(c)
+		case c == rr.d.delim:
+			rec.fields = append(rec.fields, field.String())
+			field.Reset()
+
+			wasQuote, afterEnd = false, false
+		case rr.crBeforeLF(c):
+			// dropped, the LF ends the record
+		case c == rr.d.lineTerm:
+			rec.fields = append(rec.fields, field.String())
+			all := rr.raw.String()
+			rec.raw = strings.TrimSuffix(strings.TrimSuffix(all, string(c)), "\r")
+			rec.term = all[len(rec.raw):]
+
+			if bad != "" {
+				return rec, &malformedError{rec.line, rec.offset, bad}
+			}
+
+			return rec, nil
+		case rr.d.quote != 0 && c == rr.d.quote && field.Len() == 0 && !wasQuote && !afterEnd:
+			inQuotes, wasQuote = true, true
+		case afterEnd:
+			if bad == "" {
+				bad = "text after closing quote"
+			}
+
+			field.WriteByte(c)
+		default:
+			if rr.d.quote != 0 && c == rr.d.quote && bad == "" {
+				bad = "quote inside unquoted field"
+			}
+
+			field.WriteByte(c)
+		}
+	}
+
+	rec.fields = append(rec.fields, field.String())
+	rec.raw = rr.raw.String()
+
+	if bad != "" {
+		return rec, &malformedError{rec.line, rec.offset, bad}
+	}
+
+	return rec, nil
+}
+
+// encodeRecord is the inverse of Read: it joins the fields with the
+// delimiter, quoting any field that holds a delimiter, quote or line
+// break.  With no quote character those are escaped instead.  There is
+// no line terminator on the end.
+func encodeRecord(fields []string, d dialect) string {
+	var b strings.Builder
+
+	special := string([]byte{d.delim, '\r', '\n'})
+	if d.quote != 0 {
+		special += string(d.quote)
+	}
+
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(d.delim)
+		}
+
+		if d.escape != 0 && d.escape != d.quote {
+			f = strings.ReplaceAll(f, string(d.escape), string([]byte{d.escape, d.escape}))
+		}
+
+		switch {
+		case !strings.ContainsAny(f, special):
+			b.WriteString(f)
+		case d.quote != 0:
+			inner := string([]byte{d.quote, d.quote}) // doubled
+			if d.escape != 0 && d.escape != d.quote {
+				inner = string([]byte{d.escape, d.quote})
+			}
+
+			b.WriteByte(d.quote)
+			b.WriteString(strings.ReplaceAll(f, string(d.quote), inner))
+			b.WriteByte(d.quote)
+		case d.escape != 0:
+			for j := range len(f) {
+				if strings.IndexByte(special, f[j]) >= 0 {
+					b.WriteByte(d.escape)
+				}
+
+				b.WriteByte(f[j])
+			}
+		default:
+			b.WriteString(f) // nothing we can do, the reader will split it
+		}
+	}
+
+	return b.String()
+}
+
+// dialectChar turns a config name into the character.  Names avoid
+// the # and whitespace the config reader would eat.
+func dialectChar(name string, def byte) byte {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "":
+		return def
+	case "tab", "\\t":
+		return '\t'
+	case "comma":
+		return ','
+	case "pipe":
+		return '|'
+	case "semicolon":
+		return ';'
+	case "dquote":
+		return '"'
+	case "squote":
+		return '\''
+	case "backslash":
+		return '\\'
+	case "lf", "crlf":
+		return '\n'
+	case "cr":
+		return '\r'
+	case "none":
+		return 0
+	default:
+		return name[0]
+	}
+}
+
+// dialectFor builds the dialect for one scanner from its delimiter
+// config key, the shared csv* keys and the per file header rules.  An
+// empty csvQuote means no quoting for TSV, where a quote is just text,
+// and double quotes for the rest.
+func dialectFor(delimKey string, hasHeader bool, key string) dialect {
+	delim := dialectChar(theConfig[delimKey].StrVal, '\t')
+	quote := byte('"')
+
+	if delim == '\t' {
+		quote = 0
+	}
+
+	d := dialect{
+		delim:     delim,
+		quote:     dialectChar(theConfig["csvQuote"].StrVal, quote),
+		escape:    dialectChar(theConfig["csvEscape"].StrVal, 0),
+		lineTerm:  dialectChar(theConfig["csvLineTerminator"].StrVal, '\n'),
+		crlf:      strings.EqualFold(strings.TrimSpace(theConfig["csvLineTerminator"].StrVal), "crlf"),
+		hasHeader: hasHeader,
+		maxRecord: theConfig["maxRecordBytes"].IntVal,
+	}
+
+	if h, ok := headerRuleFor(key); ok {
+		d.hasHeader = h
+	}
+
+	return d
+}
+
+// headerRule says whether keys matching pattern (a glob or a key
+// prefix) have a header row.
+type headerRule struct {
+	pattern   string
+	hasHeader bool
+}
+
+// headerRuleFor returns the first header rule that matches key.
+func headerRuleFor(key string) (bool, bool) {
+	for _, r := range theCtx.headerRules {
+		if ok, _ := path.Match(r.pattern, key); ok || strings.HasPrefix(key, r.pattern) {
+			return r.hasHeader, true
+		}
+	}
+
+	return false, false
+}
+
+// readHeaderRulesFile reads "<glob or prefix> <true|false>" lines.
+func readHeaderRulesFile(filename string) ([]headerRule, error) {
+	var rules []headerRule
+
+	if len(filename) == 0 {
+		return rules, nil
+	}
+
+	binaryFilename, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	filePath := path.Join(path.Dir(binaryFilename), filename)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Println("Warning: can't open header rules file", filename, filePath, err.Error())
+
+		return rules, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[:1] == "#" {
+			continue
+		}
+
+		f := strings.Fields(line)
+		if len(f) != headerRuleFields {
+			fmt.Println("Skipping bad header rule", line)
+
+			continue
+		}
+
+		rules = append(rules, headerRule{f[0], f[1] == "true" || f[1] == "1"})
+	}
+
+	return rules, scanner.Err()
+}
@@ -0,0 +1,421 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	slashFixEscape  = "escape"
+	slashFixStrip   = "strip"
+	slashFixReplace = "replace"
+)
+
+// repairHeader is the header row of the slash repair report.  Rows
+// with a line are changed rows, found by the scan before anything is
+// written, so in danger mode they are row-planned; the row without a
+// line is the whole file and says what happened to it.
+var repairHeader = []string{"bucket", "key", "target_key", "line", "before_sha256", "after_sha256", "action"}
+
+// repairResult is what one pass over the object found.
+type repairResult struct {
+	rows      int
+	changed   int
+	before    string // sha256 of the uncompressed source
+	after     string // sha256 of the uncompressed result
+	codec     string
+	malformed int                // rows copied as is because they didn't parse
+	meta      s3.GetObjectOutput // source metadata, without the body
+	written   string             // ETag of the uploaded target
+}
+
+// repairAllowed is the readOnly/danger guard for this mode.
+func repairAllowed() bool {
+	return theConfig["readOnly"].StrVal == danger &&
+		theConfig["setToDangerToRepair"].StrVal == danger
+}
+
+// fixSlashes applies the slashFix to one field.
+func fixSlashes(val string) string {
+	switch theConfig["slashFix"].StrVal {
+	case slashFixStrip:
+		return strings.ReplaceAll(val, "\\", "")
+	case slashFixReplace:
+		return strings.ReplaceAll(val, "\\", theConfig["slashReplaceWith"].StrVal)
+	default: // escape
+		return strings.ReplaceAll(val, "\\", "\\\\")
+	}
+}
+
+// repairTarget is where the repaired object goes: the key plus
+// repairTargetSuffix, or the key itself if that is empty.
+func repairTarget(k string) string {
+	return k + theConfig["repairTargetSuffix"].StrVal
+}
+
+// isRepairOutput is true for our own targets and backups, so a rerun
+// doesn't repair them again.
+func isRepairOutput(k string) bool {
+	suffix := theConfig["repairTargetSuffix"].StrVal
+	backup := theConfig["repairBackupPrefix"].StrVal
+
+	return (suffix != "" && strings.HasSuffix(k, suffix)) || (backup != "" && strings.HasPrefix(k, backup))
+}
+
+// hashSum is the hex sha256 so far.
+func hashSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// repairStream reads the object, fixes the fields with backslashes and
+// writes every row to w: unchanged and malformed rows byte for byte,
+// changed rows re-encoded, each with the terminator it had.  With
+// report set each changed row's hashes go in the report.
+func repairStream(b string, k string, w io.Writer, report bool, sess *session.Session) (repairResult, error) { //nolint:cyclop
+	var res repairResult
+
+	count.Incr("aws-get-object")
+
+	resp, err := s3.New(sess).GetObject(&s3.GetObjectInput{Bucket: aws.String(b), Key: aws.String(k)})
+	if err != nil {
+		return res, err
+	}
+
+	defer resp.Body.Close()
+
+	body, codec, done, err := decodeBody(b, k, resp)
+	if err != nil {
+		return res, err
+	}
+
+	defer done()
+
+	res.codec = codec
+	res.meta = *resp
+	res.meta.Body = nil
+
+	d := dialectFor("slashCheckDelimiter", theConfig["slashCheckHasHeader"].BoolVal, k)
+	rr := newRecordReader(body, d)
+	before, after := sha256.New(), sha256.New()
+	action := "row-dry-run"
+
+	if repairAllowed() {
+		action = "row-planned"
+	}
+
+	for n := 0; ; n++ {
+		rec, err := rr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil && !countMalformed(err, "slash-repair", b, k) {
+			return res, err
+		}
+
+		if err != nil {
+			res.malformed++
+		}
+
+		out := rec.raw
+
+		if err == nil && (n > 0 || !d.hasHeader) {
+			fixed := make([]string, len(rec.fields))
+			changed := false
+
+			for i, f := range rec.fields {
+				fixed[i] = f
+
+				if strings.Contains(f, "\\") {
+					fixed[i] = fixSlashes(f)
+					changed = true
+				}
+			}
+
+			if changed {
+				out = encodeRecord(fixed, d)
+				res.changed++
+			}
+		}
+
+		res.rows++
+
+		_, _ = io.WriteString(before, rec.raw+rec.term)
+		_, _ = io.WriteString(after, out+rec.term)
+
+		if _, err := io.WriteString(w, out+rec.term); err != nil {
+			return res, err
+		}
+
+		if report && out != rec.raw {
+			bh, ah := sha256.Sum256([]byte(rec.raw)), sha256.Sum256([]byte(out))
+
+			writeReportRow(theConfig["repairReport"].StrVal, repairHeader, []string{
+				b, k, repairTarget(k), strconv.Itoa(rec.line), hex.EncodeToString(bh[:]), hex.EncodeToString(ah[:]), action,
+			})
+		}
+	}
+
+	res.before, res.after = hashSum(before), hashSum(after)
+
+	return res, nil
+}
+
+// backupObject copies the original aside with its own SSE before it
+// is overwritten; metadata comes along with the copy.
+func backupObject(b string, k string, meta s3.GetObjectOutput, svc *s3.S3) error {
+	input := &s3.CopyObjectInput{
+		Bucket:               aws.String(b),
+		Key:                  aws.String(theConfig["repairBackupPrefix"].StrVal + k),
+		CopySource:           aws.String(copySourceFor(b, k)),
+		ServerSideEncryption: meta.ServerSideEncryption,
+		SSEKMSKeyId:          meta.SSEKMSKeyId,
+	}
+
+	count.Incr("aws-copy-repair-backup")
+
+	_, err := svc.CopyObject(input)
+
+	return err
+}
+
+// repairDoneKey is the doneObjects entry for an object overwritten in
+// place, with the ETag we wrote so a later change is repaired again.
+func repairDoneKey(b string, k string, etag string) string {
+	return "repair-" + keyName(b, k) + "-" + etag
+}
+
+// objectExtras reads what the upload can't get from GetObject: the
+// tags, and the ACL if it grants anything beyond the owner (nil if
+// not).
+func objectExtras(b string, k string, svc *s3.S3) (string, *s3.AccessControlPolicy, error) {
+	count.Incr("aws-get-object-tagging-repair")
+
+	tags, err := svc.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String(b), Key: aws.String(k)})
+	if err != nil {
+		return "", nil, err
+	}
+
+	v := url.Values{}
+	for _, t := range tags.TagSet {
+		v.Set(aws.StringValue(t.Key), aws.StringValue(t.Value))
+	}
+
+	count.Incr("aws-get-object-acl-repair")
+
+	acl, err := svc.GetObjectAcl(&s3.GetObjectAclInput{Bucket: aws.String(b), Key: aws.String(k)})
+	if err != nil {
+		return "", nil, err
+	}
+
+	owner := ""
+	if acl.Owner != nil {
+		owner = aws.StringValue(acl.Owner.ID)
+	}
+
+	for _, g := range acl.Grants {
+		if g.Grantee == nil || aws.StringValue(g.Grantee.ID) != owner {
+			return v.Encode(), &s3.AccessControlPolicy{Owner: acl.Owner, Grants: acl.Grants}, nil
+		}
+	}
+
+	return v.Encode(), nil, nil
+}
+
+// uploadRepaired streams the fixed object to the target with the
+// source's compression, encryption, metadata and tags.
+func uploadRepaired(b string, k string, res repairResult, tags string, sess *session.Session) (repairResult, error) {
+	pr, pw := io.Pipe()
+	results := make(chan repairResult, 1)
+
+	go func() {
+		var r repairResult
+
+		enc, err := encodeWriter(res.codec, pw)
+		if err == nil {
+			r, err = repairStream(b, k, enc, false, sess)
+			if cerr := enc.Close(); err == nil {
+				err = cerr
+			}
+		}
+
+		pw.CloseWithError(err)
+		results <- r
+	}()
+
+	m := res.meta
+	input := &s3manager.UploadInput{
+		Bucket:                  aws.String(b),
+		Key:                     aws.String(repairTarget(k)),
+		Body:                    pr,
+		CacheControl:            m.CacheControl,
+		ContentDisposition:      m.ContentDisposition,
+		ContentEncoding:         m.ContentEncoding,
+		ContentLanguage:         m.ContentLanguage,
+		ContentType:             m.ContentType,
+		Metadata:                m.Metadata,
+		ServerSideEncryption:    m.ServerSideEncryption,
+		SSEKMSKeyId:             m.SSEKMSKeyId,
+		BucketKeyEnabled:        m.BucketKeyEnabled,
+		StorageClass:            m.StorageClass,
+		WebsiteRedirectLocation: m.WebsiteRedirectLocation,
+	}
+
+	if tags != "" {
+		input.Tagging = aws.String(tags)
+	}
+
+	count.Incr("aws-upload-repair")
+
+	out, err := s3manager.NewUploader(sess).Upload(input)
+
+	pr.CloseWithError(err) // let the writer go if the upload stopped early
+
+	r := <-results
+	if err == nil {
+		r.written = aws.StringValue(out.ETag)
+	}
+
+	return r, err
+}
+
+// repairSlashesInObject fixes the backslashes in one object.  A first
+// pass finds and reports the changed rows; in danger mode a second
+// pass streams the fixed rows to the target, after backing up the
+// original if it is being overwritten.  The target keeps the
+// source's tags and ACL.  An object we overwrote is remembered by its
+// new ETag so a rerun doesn't fix it again, which for escape would
+// double the backslashes.
+func repairSlashesInObject(b string, k string, sess *session.Session) { //nolint:cyclop,funlen
+	if isRepairOutput(k) {
+		count.Incr("slash-repair-skip-own-output")
+
+		return
+	}
+
+	target := repairTarget(k)
+	svc := s3.New(sess)
+
+	if target == k {
+		count.Incr("aws-head-object-repair")
+
+		head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(b), Key: aws.String(k)})
+		if err == nil && theCtx.doneObjects.InSet(repairDoneKey(b, k, aws.StringValue(head.ETag))) {
+			count.Incr("slash-repair-skip-done")
+
+			return
+		}
+	}
+
+	row := func(before, after, action string) {
+		writeReportRow(theConfig["repairReport"].StrVal, repairHeader, []string{b, k, target, "", before, after, action})
+	}
+
+	res, err := repairStream(b, k, io.Discard, true, sess)
+	if err != nil {
+		logCountErrTag(err, "slash repair scan failed "+b+"/"+k, b)
+		row("", "", "scan-failed")
+
+		return
+	}
+
+	fmt.Println("Slash repair:", res.rows, "rows,", res.changed, "to fix in", b, k)
+	count.IncrDelta("slash-repair-rows-changed", int64(res.changed))
+
+	switch {
+	case res.changed == 0:
+		count.Incr("slash-repair-clean")
+
+		return
+	case !repairAllowed():
+		count.Incr("slash-repair-dry-run")
+		row(res.before, res.after, "dry-run")
+
+		return
+	case res.codec == codecBzip2:
+		count.Incr("slash-repair-skip-bzip2")
+		row(res.before, res.after, "skip-cant-write-bzip2")
+
+		return
+	case target == k && res.malformed > 0:
+		// the fix couldn't be checked on those rows; the source is the
+		// only good copy so don't replace it
+		count.Incr("slash-repair-skip-malformed")
+		row(res.before, res.after, fmt.Sprintf("skip-%d-malformed-rows", res.malformed))
+
+		return
+	case aws.StringValue(res.meta.SSECustomerAlgorithm) != "":
+		count.Incr("slash-repair-skip-ssec")
+		row(res.before, res.after, "skip-sse-c")
+
+		return
+	}
+
+	tags, acl, err := objectExtras(b, k, svc)
+	if err != nil {
+		// without them the target would lose the source's tags or grants
+		logCountErrTag(err, "slash repair can't read tags or ACL "+b+"/"+k, b)
+		row(res.before, res.after, "skip-cant-read-tags-acl")
+
+		return
+	}
+
+	if target == k {
+		if err := backupObject(b, k, res.meta, svc); err != nil {
+			logCountErrTag(err, "slash repair backup failed "+b+"/"+k, b)
+			row(res.before, res.after, "backup-failed")
+
+			return
+		}
+	}
+
+	res2, err := uploadRepaired(b, k, res, tags, sess)
+	if err == nil && target == k {
+		theCtx.doneObjects.Add(repairDoneKey(b, k, res2.written))
+	}
+
+	if err == nil && acl != nil {
+		count.Incr("aws-put-object-acl-repair")
+
+		_, err = svc.PutObjectAcl(&s3.PutObjectAclInput{
+			Bucket: aws.String(b), Key: aws.String(target), AccessControlPolicy: acl,
+		})
+		if err != nil {
+			logCountErrTag(err, "slash repair ACL restore failed "+b+"/"+target, b)
+			row(res2.before, res2.after, "acl-restore-failed")
+
+			return
+		}
+	}
+
+	switch {
+	case err != nil:
+		logCountErrTag(err, "slash repair upload failed "+b+"/"+target, b)
+		row(res.before, res.after, "upload-failed")
+	case res2.before != res.before:
+		// the object changed between the passes; what was written was
+		// fixed from the newer copy
+		count.Incr("slash-repair-source-changed")
+		row(res2.before, res2.after, "fixed-source-changed")
+	default:
+		count.Incr("slash-repair-fixed")
+		log.Println("Slash repair wrote", b, target)
+		row(res2.before, res2.after, "fixed")
+	}
+}
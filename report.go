@@ -0,0 +1,95 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"os"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// reportWriter is a CSV file that many go routines can add rows to.
+type reportWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+// getReport returns the report for filename, creating it and writing
+// the header the first time it is asked for.  Returns nil if the file
+// can't be created (already logged).
+func getReport(filename string, header []string) *reportWriter {
+	theCtx.reportsRW.Lock()
+	defer theCtx.reportsRW.Unlock()
+
+	if r, ok := theCtx.reports[filename]; ok {
+		return r
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Println("Can't create report file", filename, err)
+		count.Incr("report-create-error")
+
+		return nil
+	}
+
+	log.Println("Writing report", filename)
+
+	r := &reportWriter{f: f, w: csv.NewWriter(f)}
+
+	_ = r.w.Write(header)
+	theCtx.reports[filename] = r
+
+	return r
+}
+
+// writeReportRow adds one row to the named report, flushing so a
+// crashed run still leaves the rows it got.
+func writeReportRow(filename string, header []string, row []string) {
+	r := getReport(filename, header)
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.w.Write(row)
+	if err == nil {
+		r.w.Flush()
+		err = r.w.Error()
+	}
+
+	if err != nil {
+		log.Println("Error writing report", filename, err)
+		count.Incr("report-write-error")
+
+		return
+	}
+
+	count.Incr("report-row")
+
+	recordHistoryRow(filename, header, row)
+}
+
+// closeReports flushes and closes all the reports at exit.
+func closeReports() {
+	theCtx.reportsRW.Lock()
+	defer theCtx.reportsRW.Unlock()
+
+	for name, r := range theCtx.reports {
+		r.mu.Lock()
+		r.w.Flush()
+
+		if err := r.f.Close(); err != nil {
+			log.Println("Error closing report", name, err)
+		}
+
+		r.mu.Unlock()
+		delete(theCtx.reports, name)
+	}
+}
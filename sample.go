@@ -0,0 +1,246 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	s3Scheme     = "s3://"
+	sampleSuffix = ".samples.csv"
+	scopeFile    = "file"
+	scopeColumn  = "column"
+)
+
+// sampleHeader is the header row of the row samples.
+var sampleHeader = []string{"bucket", "key", "scope", "column", "seen", "line", "offset", "row"}
+
+// sampledRow is one offending row.  line is 0 when the row came from a
+// range scan, which doesn't know line numbers.
+type sampledRow struct {
+	line   int
+	offset int64
+	raw    string
+}
+
+// reservoir keeps a uniform sample of up to capacity of the rows
+// added to it (Algorithm R).
+type reservoir struct {
+	capacity int
+	seen     int64
+	rows     []sampledRow
+}
+
+// add offers one row.
+func (r *reservoir) add(row sampledRow, rng *rand.Rand) {
+	r.seen++
+
+	if len(r.rows) < r.capacity {
+		r.rows = append(r.rows, row)
+
+		return
+	}
+
+	if i := rng.Int63n(r.seen); i < int64(r.capacity) {
+		r.rows[i] = row
+	}
+}
+
+// rowSampler samples one file's offending rows, overall and per
+// column.  It's seeded from the bucket and key so a rerun over the
+// same file picks the same rows.  Safe for the range scan go routines.
+type rowSampler struct {
+	mu      sync.Mutex
+	bucket  string
+	key     string
+	rng     *rand.Rand
+	file    reservoir
+	columns map[string]*reservoir
+}
+
+// newRowSampler makes the sampler for a file, nil if slashSampleRows
+// is 0.
+func newRowSampler(bucket string, key string) *rowSampler {
+	capacity := theConfig["slashSampleRows"].IntVal
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &rowSampler{
+		bucket:  bucket,
+		key:     key,
+		rng:     rand.New(rand.NewSource(int64(hashString(bucket + "/" + key)))), //nolint:gosec
+		file:    reservoir{capacity: capacity},
+		columns: make(map[string]*reservoir),
+	}
+}
+
+// add offers an offending row and the columns it offends in.
+func (s *rowSampler) add(cols []string, row sampledRow) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.file.add(row, s.rng)
+
+	for _, c := range cols {
+		r, ok := s.columns[c]
+		if !ok {
+			r = &reservoir{capacity: s.file.capacity}
+			s.columns[c] = r
+		}
+
+		r.add(row, s.rng)
+	}
+}
+
+// rows returns the sample report rows, file first then columns by
+// name, each in file order.
+func (s *rowSampler) rows() [][]string {
+	var res [][]string
+
+	addRows := func(scope string, col string, r *reservoir) {
+		sort.Slice(r.rows, func(i, j int) bool { return r.rows[i].offset < r.rows[j].offset })
+
+		for _, row := range r.rows {
+			line := ""
+			if row.line > 0 {
+				line = strconv.Itoa(row.line)
+			}
+
+			res = append(res, []string{
+				s.bucket, s.key, scope, col, strconv.FormatInt(r.seen, 10), line,
+				strconv.FormatInt(row.offset, 10), row.raw,
+			})
+		}
+	}
+
+	addRows(scopeFile, "", &s.file)
+
+	cols := make([]string, 0, len(s.columns))
+	for c := range s.columns {
+		cols = append(cols, c)
+	}
+
+	sort.Strings(cols)
+
+	for _, c := range cols {
+		addRows(scopeColumn, c, s.columns[c])
+	}
+
+	return res
+}
+
+// sampleSession is the session for the sample bucket: our own
+// credentials, not the scanned account's, in the sample bucket's
+// region.  nil if there isn't one.
+func sampleSession(bucket string) *session.Session {
+	theCtx.sampleSessOnce.Do(func() {
+		sess := getSessForAcct("0")
+
+		region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, theConfig["awsRegion"].StrVal)
+		if err != nil {
+			logCountErrTag(err, "can't determine region for sample bucket "+bucket, bucket)
+
+			return
+		}
+
+		theCtx.sampleSess, err = session.NewSession(sess.Config.Copy(&aws.Config{Region: aws.String(region)}))
+		if err != nil {
+			log.Println("Can't create session for sample bucket", bucket, region, err)
+		}
+	})
+
+	return theCtx.sampleSess
+}
+
+// sampleUploadAllowed is the readOnly/danger guard for writing samples
+// to S3.
+func sampleUploadAllowed() bool {
+	return theConfig["readOnly"].StrVal == danger &&
+		theConfig["setToDangerToWriteSamples"].StrVal == danger
+}
+
+// write saves the sample: rows added to the slashSampleTarget report,
+// or with an s3://bucket/prefix target one object per file under the
+// prefix, named for the file's bucket and key.  Writing to S3 needs
+// setToDangerToWriteSamples.
+func (s *rowSampler) write() {
+	if s == nil || s.file.seen == 0 {
+		return
+	}
+
+	target := theConfig["slashSampleTarget"].StrVal
+	rows := s.rows()
+
+	count.IncrDelta("slash-sample-rows", int64(len(rows)))
+
+	if !strings.HasPrefix(target, s3Scheme) {
+		for _, row := range rows {
+			writeReportRow(target, sampleHeader, row)
+		}
+
+		return
+	}
+
+	var buf bytes.Buffer
+
+	w := csv.NewWriter(&buf)
+	_ = w.Write(sampleHeader)
+	_ = w.WriteAll(rows)
+
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(target, s3Scheme), "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	key := prefix + s.bucket + "/" + s.key + sampleSuffix
+
+	if !sampleUploadAllowed() {
+		count.Incr("slash-sample-dry-run")
+		fmt.Println("Would write", len(rows), "sample rows to", fmt.Sprintf("%s%s/%s", s3Scheme, bucket, key))
+
+		return
+	}
+
+	sess := sampleSession(bucket)
+	if sess == nil {
+		count.Incr("slash-sample-no-session")
+
+		return
+	}
+
+	count.Incr("aws-put-object-sample")
+
+	_, err := s3.New(sess).PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("text/csv"),
+	})
+	if err != nil {
+		logCountErrTag(err, "sample upload failed "+bucket+"/"+key, s.bucket)
+
+		return
+	}
+
+	log.Println("Wrote", len(rows), "sample rows to", fmt.Sprintf("%s%s/%s", s3Scheme, bucket, key))
+}
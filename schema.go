@@ -0,0 +1,364 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	schemaMinFields = 2
+	regexPrefix     = "regex:"
+	enumPrefix      = "enum:"
+	notNull         = "notnull"
+	nullable        = "null"
+)
+
+// schemaHeader is the header row of the schema violations report.
+var schemaHeader = []string{"bucket", "key", "line", "column", "name", "issue", "value", "detail"}
+
+// schemaColumn is one line of the schema file.
+type schemaColumn struct {
+	name     string
+	typ      string
+	nullable bool
+	re       *regexp.Regexp
+	enum     map[string]bool
+}
+
+// prefixHeader is the first header seen under a prefix, to compare
+// later files with.
+type prefixHeader struct {
+	key    string
+	fields []string
+}
+
+// parseSchemaLine parses
+// "<name> <int|float|date|bool|string> [null|notnull] [enum:a,b,c] [regex:<re to end of line>]".
+// Columns are nullable unless marked notnull.
+func parseSchemaLine(line string) (schemaColumn, error) {
+	var c schemaColumn
+
+	if i := strings.Index(line, " "+regexPrefix); i >= 0 {
+		re, err := regexp.Compile("^(?:" + line[i+1+len(regexPrefix):] + ")$")
+		if err != nil {
+			return c, err
+		}
+
+		c.re = re
+		line = line[:i]
+	}
+
+	f := strings.Fields(line)
+	if len(f) < schemaMinFields {
+		return c, fmt.Errorf("want name and type: %s", line) //nolint:err113
+	}
+
+	c.name, c.typ, c.nullable = f[0], strings.ToLower(f[1]), true
+
+	switch c.typ {
+	case typeInt, typeFloat, typeDate, typeBool, typeString:
+	default:
+		return c, fmt.Errorf("unknown type %s: %s", c.typ, line) //nolint:err113
+	}
+
+	for _, o := range f[schemaMinFields:] {
+		switch {
+		case o == notNull:
+			c.nullable = false
+		case o == nullable:
+			c.nullable = true
+		case strings.HasPrefix(o, enumPrefix):
+			c.enum = make(map[string]bool)
+			for _, v := range strings.Split(strings.TrimPrefix(o, enumPrefix), ",") {
+				c.enum[v] = true
+			}
+		default:
+			return c, fmt.Errorf("unknown option %s: %s", o, line) //nolint:err113
+		}
+	}
+
+	return c, nil
+}
+
+// readSchemaFile reads the schema, one column per line in file order.
+func readSchemaFile(filename string) ([]schemaColumn, error) {
+	var cols []schemaColumn
+
+	if len(filename) == 0 {
+		return cols, nil
+	}
+
+	binaryFilename, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	filePath := path.Join(path.Dir(binaryFilename), filename)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Println("Warning: can't open schema file", filename, filePath, err.Error())
+
+		return cols, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[:1] == "#" {
+			continue
+		}
+
+		c, err := parseSchemaLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("schema file %s line %d: %w", filename, lineNum, err)
+		}
+
+		cols = append(cols, c)
+	}
+
+	return cols, scanner.Err()
+}
+
+// typeOK is true if val parses as the column type.  Unlike inferType
+// this doesn't pick the most specific type, so 20240102 is a date in a
+// date column and 1 is a float in a float column.
+func typeOK(typ string, val string) bool {
+	switch typ {
+	case typeInt:
+		_, err := strconv.ParseInt(val, 10, 64)
+
+		return err == nil
+	case typeFloat:
+		_, err := strconv.ParseFloat(val, 64)
+
+		return err == nil
+	case typeDate:
+		for _, l := range dateLayouts {
+			if _, err := time.Parse(l, val); err == nil {
+				return true
+			}
+		}
+
+		return false
+	case typeBool:
+		return inferType(val) == typeBool
+	default:
+		return true
+	}
+}
+
+// check returns the issue and detail for one value, or "" if it is fine.
+func (c schemaColumn) check(val string) (string, string) {
+	if isNullValue(val) {
+		if !c.nullable {
+			return "null-in-notnull", ""
+		}
+
+		return "", ""
+	}
+
+	switch {
+	case !typeOK(c.typ, val):
+		return "bad-type", "want " + c.typ + " got " + inferType(val)
+	case c.enum != nil && !c.enum[val]:
+		return "not-in-enum", ""
+	case c.re != nil && !c.re.MatchString(val):
+		return "regex-mismatch", c.re.String()
+	}
+
+	return "", ""
+}
+
+// schemaViolations reports violations for one file, up to
+// schemaMaxViolationsPerFile rows; the rest are only counted.
+type schemaViolations struct {
+	bucket string
+	key    string
+	n      int
+}
+
+// add counts and maybe reports a violation.
+func (v *schemaViolations) add(line int, col int, name string, issue string, value string, detail string) {
+	v.n++
+
+	count.Incr("schema-violation")
+	count.Incr("schema-violation-" + issue)
+	count.Incr("schema-violation-" + v.bucket)
+
+	if v.n > theConfig["schemaMaxViolationsPerFile"].IntVal {
+		count.Incr("schema-violation-unreported")
+
+		return
+	}
+
+	writeReportRow(theConfig["schemaReport"].StrVal, schemaHeader, []string{
+		v.bucket, v.key, strconv.Itoa(line), strconv.Itoa(col), name, issue, value, detail,
+	})
+}
+
+// checkHeaderDrift compares a file's header with the first header
+// seen in the same prefix.
+func checkHeaderDrift(bucket string, key string, fields []string, v *schemaViolations) {
+	prefix := bucket + "/" + path.Dir(key)
+
+	theCtx.schemaRW.Lock()
+	first, ok := theCtx.prefixHeaders[prefix]
+
+	if !ok {
+		theCtx.prefixHeaders[prefix] = prefixHeader{key, fields}
+	}
+	theCtx.schemaRW.Unlock()
+
+	if !ok {
+		return
+	}
+
+	same := len(first.fields) == len(fields)
+
+	for i := 0; same && i < len(fields); i++ {
+		same = first.fields[i] == fields[i]
+	}
+
+	if same {
+		return
+	}
+
+	count.Incr("schema-header-drift")
+	fmt.Println("Header drift", bucket, key, "differs from", first.key)
+	v.add(1, -1, "", "header-drift", strings.Join(fields, " "), "differs from "+first.key+": "+strings.Join(first.fields, " "))
+}
+
+// checkSchemaHeader compares a file's header with the schema.
+func checkSchemaHeader(fields []string, v *schemaViolations) {
+	for i, c := range theCtx.schema {
+		switch {
+		case i >= len(fields):
+			v.add(1, i, c.name, "header-missing-column", "", "")
+		case !strings.EqualFold(fields[i], c.name):
+			v.add(1, i, c.name, "header-name-mismatch", fields[i], "")
+		}
+	}
+
+	for i := len(theCtx.schema); i < len(fields); i++ {
+		v.add(1, i, "", "header-extra-column", fields[i], "")
+	}
+}
+
+// validateObjectSchema streams one object and checks every row
+// against the schema, and its header against the schema and the other
+// files in its prefix.
+func validateObjectSchema(bucket string, key string, sess *session.Session) { //nolint:cyclop
+	if !keyHasSuffix(key, theConfig["schemaKeySuffixes"].StrVal) {
+		count.Incr("schema-skip-key")
+
+		return
+	}
+
+	count.Incr("aws-get-object")
+
+	resp, err := s3.New(sess).GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		logCountErrTag(err, "GetObject failed "+bucket+"/"+key, bucket)
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	body, done, err := decodedBody(bucket, key, resp)
+	if err != nil {
+		log.Println("Error decompressing object", bucket, key, err)
+		count.Incr("schema-decompress-error")
+
+		return
+	}
+
+	defer done()
+
+	d := dialectFor("schemaDelimiter", theConfig["schemaHasHeader"].BoolVal, key)
+	rr := newRecordReader(body, d)
+	v := &schemaViolations{bucket: bucket, key: key}
+	rows := 0
+	needHeader := d.hasHeader
+
+	for {
+		rec, err := rr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil && !countMalformed(err, "schema", bucket, key) {
+			log.Println("Error scanning object", bucket, key, err)
+			count.Incr("schema-scan-error")
+
+			return
+		}
+
+		if err != nil {
+			v.add(rec.line, -1, "", "malformed-row", rec.raw, err.Error())
+		}
+
+		if needHeader {
+			needHeader = false
+
+			fields := make([]string, len(rec.fields))
+			for i, f := range rec.fields {
+				fields[i] = strings.TrimSpace(f)
+			}
+
+			checkHeaderDrift(bucket, key, fields, v)
+			checkSchemaHeader(fields, v)
+
+			continue
+		}
+
+		rows++
+
+		count.Incr("schema-row")
+
+		if len(rec.fields) != len(theCtx.schema) {
+			v.add(rec.line, -1, "", "column-count", strconv.Itoa(len(rec.fields)),
+				"want "+strconv.Itoa(len(theCtx.schema)))
+		}
+
+		for i, c := range theCtx.schema {
+			if i >= len(rec.fields) {
+				break
+			}
+
+			if issue, detail := c.check(rec.fields[i]); issue != "" {
+				v.add(rec.line, i, c.name, issue, rec.fields[i], detail)
+			}
+		}
+	}
+
+	count.Incr("schema-file")
+
+	if v.n > 0 {
+		count.Incr("schema-file-bad")
+		fmt.Println("Schema violations", v.n, "in", rows, "rows", bucket, key)
+	}
+}
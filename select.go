@@ -0,0 +1,301 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	selectCountCols = 3 // rows, missing, null
+	formatJSON      = "json"
+	formatCSV       = "csv"
+	selectNoQuote   = "\x01" // a quote character TSV data won't have
+)
+
+var (
+	errSelectResult = errors.New("unexpected S3 Select result")
+	selectIdentRe   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// selectColumn is the column reference for a named field.  Unquoted
+// names are case insensitive in S3 Select, like findFieldIndex; a
+// name that needs quoting would be matched exactly, so returns false.
+func selectColumn(fieldName string) (string, bool) {
+	if !selectIdentRe.MatchString(fieldName) {
+		return "", false
+	}
+
+	return "s." + fieldName, true
+}
+
+// selectFormat is how S3 Select should read the key: Parquet, JSON
+// lines or CSV, "" for ORC, which it can't.
+func selectFormat(key string) string {
+	if f := columnarFormat(key); f != "" {
+		if f == formatParquet {
+			return formatParquet
+		}
+
+		return ""
+	}
+
+	k := strings.ToLower(key)
+	if codecFromKey(k) != "" {
+		k = strings.TrimSuffix(k, path.Ext(k))
+	}
+
+	for _, s := range []string{".json", ".jsonl", ".ndjson"} {
+		if strings.HasSuffix(k, s) {
+			return formatJSON
+		}
+	}
+
+	return formatCSV
+}
+
+// selectCompression maps the object's codec to S3 Select's; false for
+// codecs it doesn't read.
+func selectCompression(key string, head *s3.HeadObjectOutput) (string, bool) {
+	codec := codecFromKey(key)
+	if head != nil {
+		if c := codecFromEncoding(aws.StringValue(head.ContentEncoding)); c != "" {
+			codec = c
+		}
+	}
+
+	switch codec {
+	case "":
+		return s3.CompressionTypeNone, true
+	case codecGzip:
+		return s3.CompressionTypeGzip, true
+	case codecBzip2:
+		return s3.CompressionTypeBzip2, true
+	}
+
+	return "", false
+}
+
+// selectNullsSQL counts the rows, the rows without the column and the
+// rows where it is null the way isNullValue means it.  MISSING IS NULL
+// is true, so the null test excludes it first.
+func selectNullsSQL(col string) string {
+	str := "CAST(" + col + " AS STRING)"
+
+	return "SELECT COUNT(*), " +
+		"SUM(CASE WHEN " + col + " IS MISSING THEN 1 ELSE 0 END), " +
+		"SUM(CASE WHEN " + col + " IS NOT MISSING AND (" + col + " IS NULL OR " +
+		str + " = '' OR LOWER(" + str + ") = 'null' OR " + str + " = '\\N') THEN 1 ELSE 0 END) " +
+		"FROM S3Object s"
+}
+
+// selectNullsInput builds the request for the object, or returns false
+// if S3 Select can't answer the same question streamNulls would.
+func selectNullsInput(bucket string, key string, fieldIndex int, fieldName string,
+	head *s3.HeadObjectOutput,
+) (*s3.SelectObjectContentInput, bool) {
+	format := selectFormat(key)
+	if format == "" {
+		return nil, false
+	}
+
+	compression, ok := selectCompression(key, head)
+	if !ok {
+		return nil, false
+	}
+
+	in := &s3.InputSerialization{CompressionType: aws.String(compression)}
+
+	col, ok := selectColumn(fieldName)
+	if fieldName != "" && !ok {
+		return nil, false
+	}
+
+	switch format {
+	case formatParquet:
+		if fieldName == "" {
+			return nil, false
+		}
+
+		in.CompressionType = aws.String(s3.CompressionTypeNone)
+		in.Parquet = &s3.ParquetInput{}
+	case formatJSON:
+		if fieldName == "" {
+			return nil, false
+		}
+
+		in.JSON = &s3.JSONInput{Type: aws.String(s3.JSONTypeLines)}
+	default:
+		d := dialectFor("nullCheckDelimiter", fieldName != "", key)
+		if d.crlf {
+			return nil, false
+		}
+
+		quote := string(d.quote)
+		if d.quote == 0 {
+			quote = selectNoQuote // no quoting, as for TSV
+		}
+
+		header := s3.FileHeaderInfoNone
+
+		switch {
+		case fieldName != "" && d.hasHeader:
+			header = s3.FileHeaderInfoUse
+		case d.hasHeader:
+			header = s3.FileHeaderInfoIgnore
+			col = "s._" + strconv.Itoa(fieldIndex+1)
+		default:
+			col = "s._" + strconv.Itoa(fieldIndex+1)
+		}
+
+		in.CSV = &s3.CSVInput{
+			FileHeaderInfo:             aws.String(header),
+			FieldDelimiter:             aws.String(string(d.delim)),
+			QuoteCharacter:             aws.String(quote),
+			RecordDelimiter:            aws.String(string(d.lineTerm)),
+			AllowQuotedRecordDelimiter: aws.Bool(true),
+		}
+
+		if d.escape != 0 {
+			in.CSV.QuoteEscapeCharacter = aws.String(string(d.escape))
+		}
+	}
+
+	return &s3.SelectObjectContentInput{
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		Expression:          aws.String(selectNullsSQL(col)),
+		ExpressionType:      aws.String(s3.ExpressionTypeSql),
+		InputSerialization:  in,
+		OutputSerialization: &s3.OutputSerialization{CSV: &s3.CSVOutput{}},
+	}, true
+}
+
+// parseSelectCounts reads the one CSV row of counts; SUM of no rows
+// is empty.
+func parseSelectCounts(out []byte) ([]int, error) {
+	fields := strings.Split(strings.TrimSpace(string(out)), ",")
+	if len(fields) != selectCountCols {
+		return nil, fmt.Errorf("%w: %q", errSelectResult, out)
+	}
+
+	res := make([]int, len(fields))
+
+	for i, f := range fields {
+		if f == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errSelectResult, out)
+		}
+
+		res[i] = n
+	}
+
+	return res, nil
+}
+
+// selectCountNulls has S3 Select count the column's nulls.  False if
+// the object isn't something Select reads or the query failed, and
+// the caller should stream it instead.
+func selectCountNulls(bucket string, key string, fieldIndex int, fieldName string,
+	head *s3.HeadObjectOutput, sess *session.Session,
+) (nullTally, bool) {
+	req, ok := selectNullsInput(bucket, key, fieldIndex, fieldName, head)
+	if !ok {
+		count.Incr("null-check-select-unsupported")
+
+		return nullTally{}, false
+	}
+
+	count.Incr("aws-select-object-content")
+
+	resp, err := s3.New(sess).SelectObjectContent(req)
+	if err != nil {
+		log.Println("S3 Select failed, streaming instead", bucket, key, err)
+		count.Incr("null-check-select-error")
+
+		return nullTally{}, false
+	}
+
+	defer resp.EventStream.Close()
+
+	var out bytes.Buffer
+
+	for ev := range resp.EventStream.Events() {
+		switch e := ev.(type) {
+		case *s3.RecordsEvent:
+			out.Write(e.Payload)
+		case *s3.StatsEvent:
+			count.IncrDelta("select-bytes-scanned", aws.Int64Value(e.Details.BytesScanned))
+			count.IncrDelta("select-bytes-scanned-"+bucket, aws.Int64Value(e.Details.BytesScanned))
+			count.IncrDelta("select-bytes-returned", aws.Int64Value(e.Details.BytesReturned))
+		}
+	}
+
+	if err := resp.EventStream.Err(); err != nil {
+		log.Println("S3 Select failed, streaming instead", bucket, key, err)
+		count.Incr("null-check-select-error")
+
+		return nullTally{}, false
+	}
+
+	n, err := parseSelectCounts(out.Bytes())
+	if err != nil {
+		log.Println("S3 Select failed, streaming instead", bucket, key, err)
+		count.Incr("null-check-select-error")
+
+		return nullTally{}, false
+	}
+
+	rows, missing, nulls := n[0], n[1], n[2]
+
+	count.Incr("null-check-select")
+
+	return nullTally{lines: rows, null: nulls, total: rows - missing, missing: missing}, true
+}
+
+// countSelectNulls counts a Select result under the same names the
+// streaming path counts rows under.
+func countSelectNulls(bucket string, key string, t nullTally) {
+	baseName := path.Base(key)
+
+	for _, name := range []string{"", "-" + bucket, "-" + baseName} {
+		count.IncrDelta("row"+name, int64(t.total+t.missing))
+		count.IncrDelta("null-check-field-missing"+name, int64(t.missing))
+		count.IncrDelta("field-null"+name, int64(t.null))
+		count.IncrDelta("field-non-null"+name, int64(t.total-t.null))
+	}
+
+	finishNullCount(bucket, key, t)
+}
+
+// verifySelectNulls compares the Select counts with the streamed
+// ones.  Header lines are in the streamed lines but not Select's rows,
+// so rows are compared as total plus missing.
+func verifySelectNulls(bucket string, key string, st nullTally, t nullTally) {
+	if st.total+st.missing == t.total+t.missing && st.null == t.null && st.missing == t.missing {
+		count.Incr("null-check-select-verify-match")
+
+		return
+	}
+
+	count.Incr("null-check-select-verify-mismatch")
+	count.Incr("null-check-select-verify-mismatch-" + bucket)
+	fmt.Printf("SELECT MISMATCH %s/%s select rows=%d nulls=%d missing=%d stream rows=%d nulls=%d missing=%d\n",
+		bucket, key, st.total+st.missing, st.null, st.missing, t.total+t.missing, t.null, t.missing)
+}
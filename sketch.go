@@ -0,0 +1,209 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	hllPrecision = 12 // 4096 registers, about 1.6% error
+	hllRegisters = 1 << hllPrecision
+	wordBits     = 64
+)
+
+// hll is a HyperLogLog distinct count estimate.
+type hll struct {
+	reg [hllRegisters]uint8
+}
+
+// hashString is FNV-1a with a murmur finalizer so the high bits are
+// well mixed.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
+
+// add counts one value.
+func (h *hll) add(s string) {
+	x := hashString(s)
+	idx := x >> (64 - hllPrecision)
+	rho := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1) //nolint:gosec
+
+	if rho > h.reg[idx] {
+		h.reg[idx] = rho
+	}
+}
+
+// merge folds o into h.
+func (h *hll) merge(o *hll) {
+	for i, r := range o.reg {
+		if r > h.reg[i] {
+			h.reg[i] = r
+		}
+	}
+}
+
+// estimate returns the distinct count, using linear counting while
+// there are still empty registers and the estimate is small.
+func (h *hll) estimate() int64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+
+	for _, r := range h.reg {
+		sum += math.Ldexp(1, -int(r))
+
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(e + 0.5)
+}
+
+// topK is a Misra-Gries summary: it keeps at most capacity values, and
+// any value seen more than n/capacity times is in it.  Counts are
+// lower bounds.
+type topK struct {
+	capacity int
+	counts   map[string]int64
+}
+
+// newTopK makes an empty summary.
+func newTopK(capacity int) *topK {
+	return &topK{capacity: capacity, counts: make(map[string]int64)}
+}
+
+// add counts one value.
+func (t *topK) add(s string) {
+	if _, ok := t.counts[s]; ok || len(t.counts) < t.capacity {
+		t.counts[s]++
+
+		return
+	}
+
+	for v := range t.counts {
+		t.counts[v]--
+		if t.counts[v] == 0 {
+			delete(t.counts, v)
+		}
+	}
+}
+
+// merge folds o into t, then trims back to capacity by taking the
+// (capacity+1)th count off every value.
+func (t *topK) merge(o *topK) {
+	for v, c := range o.counts {
+		t.counts[v] += c
+	}
+
+	if len(t.counts) <= t.capacity {
+		return
+	}
+
+	cut := t.top(t.capacity + 1)[t.capacity].count
+
+	for v := range t.counts {
+		t.counts[v] -= cut
+		if t.counts[v] <= 0 {
+			delete(t.counts, v)
+		}
+	}
+}
+
+// valueCount is one entry of a topK.
+type valueCount struct {
+	value string
+	count int64
+}
+
+// top returns up to n values, most frequent first.
+func (t *topK) top(n int) []valueCount {
+	res := make([]valueCount, 0, len(t.counts))
+	for v, c := range t.counts {
+		res = append(res, valueCount{v, c})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].count != res[j].count {
+			return res[i].count > res[j].count
+		}
+
+		return res[i].value < res[j].value
+	})
+
+	if len(res) > n {
+		res = res[:n]
+	}
+
+	return res
+}
+
+// hashSet remembers 64 bit hashes; testAndAdd is true if h was
+// (probably, for a bloom filter) already there.
+type hashSet interface {
+	testAndAdd(h uint64) bool
+}
+
+// exactSet is a hashSet that grows with the number of distinct hashes.
+type exactSet map[uint64]struct{}
+
+func (s exactSet) testAndAdd(h uint64) bool {
+	if _, ok := s[h]; ok {
+		return true
+	}
+
+	s[h] = struct{}{}
+
+	return false
+}
+
+// bloom is a fixed size hashSet with false positives.
+type bloom struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// newBloom makes a filter of m bits with k probes.
+func newBloom(m uint64, k uint64) *bloom {
+	m = max(m, wordBits)
+
+	return &bloom{bits: make([]uint64, (m+wordBits-1)/wordBits), m: m, k: k}
+}
+
+// testAndAdd uses double hashing on the two halves of h.
+func (b *bloom) testAndAdd(h uint64) bool {
+	h1, h2 := h&0xffffffff, h>>32|1
+	present := true
+
+	for i := range b.k {
+		bit := (h1 + i*h2) % b.m
+		word, mask := bit/wordBits, uint64(1)<<(bit%wordBits)
+
+		if b.bits[word]&mask == 0 {
+			present = false
+			b.bits[word] |= mask
+		}
+	}
+
+	return present
+}
@@ -3,12 +3,14 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -16,12 +18,157 @@ import (
 	count "github.com/jayalane/go-counter"
 )
 
-// streamAndCheckSlashes streams an S3 object line by line as a TSV and reports,
+// slashTally is the rows of one file, or one range of it.
+type slashTally struct {
+	lines int
+	rows  int
+}
+
+// slashHeaders trims the header row's column names.
+func slashHeaders(fields []string, bucket string, key string) []string {
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	count.Incr("slash-check-header-found")
+	fmt.Println("Header has", len(fields), "columns in", bucket, key)
+
+	return fields
+}
+
+// checkSlashRow counts the stray backslashes in one row by column and
+// returns the columns that had any.
+func checkSlashRow(rec *record, headers []string, baseName string) []string {
+	count.Incr("slash-check-row")
+	count.Incr("slash-check-row-" + baseName)
+
+	var cols []string
+
+	for i, val := range rec.fields {
+		if !strings.Contains(val, "\\") {
+			continue
+		}
+
+		colName := columnLabel(headers, i)
+		cols = append(cols, colName)
+
+		count.Incr("slash-in-col-" + colName)
+		count.Incr("slash-in-col-" + colName + "-" + baseName)
+
+		// Flag the especially problematic pattern: a field that is just "\".
+		if val == "\\" {
+			count.Incr("slash-only-col-" + colName)
+			count.Incr("slash-only-col-" + colName + "-" + baseName)
+		}
+
+		// Field ending with \ — in a CSV this escapes the following delimiter.
+		if strings.HasSuffix(val, "\\") {
+			count.Incr("slash-trailing-col-" + colName)
+			count.Incr("slash-trailing-col-" + colName + "-" + baseName)
+		}
+	}
+
+	if len(cols) > 0 {
+		count.Incr("slash-rows")
+		count.Incr("slash-rows-" + baseName)
+	}
+
+	return cols
+}
+
+// printSlashHeader prints the banner before a file's first offending
+// row.
+func printSlashHeader(bucket string, key string, headers []string, d dialect) {
+	fmt.Println("=== OFFENDING ROWS in", bucket+"/"+key, "===")
+	fmt.Println("HEADER:", strings.Join(headers, string(d.delim)))
+}
+
+// finishSlashCheck prints and counts a file's lines.
+func finishSlashCheck(bucket string, key string, t slashTally) {
+	fmt.Println("Slash-scan:", t.lines, "lines,", t.rows, "rows with a stray \\ in", bucket, key)
+	count.IncrDelta("slash-check-lines", int64(t.lines))
+}
+
+// checkSlashesRanged is streamAndCheckSlashes for a big object, with
+// the byte ranges scanned at once and their tallies merged.  Ranges
+// don't know their line numbers, so offending rows are printed with
+// their byte offset instead.
+func checkSlashesRanged(bucket string, key string, hasHeader bool, head *s3.HeadObjectOutput, sess *session.Session) {
+	d := dialectFor("slashCheckDelimiter", hasHeader, key)
+	baseName := path.Base(key)
+	tallies := make([]slashTally, rangeParts(objectSize(head)))
+	printMu := sync.Mutex{}
+	headerPrinted := false
+	sampler := newRowSampler(bucket, key)
+
+	var headers []string
+
+	err := scanRanges(bucket, key, head, d, "slash-check",
+		func(fields []string) {
+			headers = slashHeaders(fields, bucket, key)
+		},
+		func(part int, rec *record, offset int64) {
+			tallies[part].lines++
+
+			cols := checkSlashRow(rec, headers, baseName)
+			if len(cols) == 0 {
+				return
+			}
+
+			tallies[part].rows++
+
+			sampler.add(cols, sampledRow{offset: offset, raw: rec.raw})
+
+			if !theConfig["slashPrintRows"].BoolVal {
+				return
+			}
+
+			printMu.Lock()
+			defer printMu.Unlock()
+
+			if !headerPrinted {
+				printSlashHeader(bucket, key, headers, d)
+
+				headerPrinted = true
+			}
+
+			fmt.Printf("FILE=%s OFFSET=%d ROW=%s\n", baseName, offset, rec.raw)
+		},
+		sess)
+	if err != nil {
+		logCountErrTag(err, "range scan failed "+bucket+"/"+key, bucket)
+		count.Incr("slash-check-scan-error")
+
+		return
+	}
+
+	total := slashTally{}
+
+	for _, t := range tallies {
+		total.lines += t.lines
+		total.rows += t.rows
+	}
+
+	sampler.write()
+	finishSlashCheck(bucket, key, total)
+}
+
+// streamAndCheckSlashes streams an S3 object record by record (comma
+// separated unless slashCheckDelimiter says otherwise) and reports,
 // per column, how many rows contain a stray backslash (\). A "stray backslash" is
 // any field that contains the \ character — including fields that are exactly "\"
 // and fields ending with \. The first line is treated as a header row if present,
 // so results are reported under the column name rather than a numeric index.
-func streamAndCheckSlashes(bucket, key string, hasHeader bool, sess *session.Session) { //nolint:cyclop,gocognit
+// Objects over rangeScanMinBytes are scanned as parallel byte ranges.
+// Offending rows are sampled to slashSampleTarget, and only printed
+// with slashPrintRows.
+func streamAndCheckSlashes(bucket, key string, hasHeader bool, head *s3.HeadObjectOutput, sess *session.Session) {
+	if rangeScannable(key, head) {
+		checkSlashesRanged(bucket, key, hasHeader, head, sess)
+
+		return
+	}
+
 	svc := s3.New(sess)
 
 	count.Incr("aws-get-object")
@@ -38,88 +185,79 @@ func streamAndCheckSlashes(bucket, key string, hasHeader bool, sess *session.Ses
 
 	defer resp.Body.Close()
 
-	scanner := bufio.NewScanner(resp.Body)
-	buf := make([]byte, 0, scannerBufSize)
-	scanner.Buffer(buf, scannerBufSize)
+	body, done, err := decodedBody(bucket, key, resp)
+	if err != nil {
+		log.Println("Error decompressing object", bucket, key, err)
+		count.Incr("slash-check-decompress-error")
 
+		return
+	}
+
+	defer done()
+
+	d := dialectFor("slashCheckDelimiter", hasHeader, key)
+	rr := newRecordReader(body, d)
 	baseName := path.Base(key)
 
 	var headers []string
 
-	if hasHeader && scanner.Scan() {
-		headers = strings.Split(scanner.Text(), ",")
-		for i := range headers {
-			headers[i] = strings.TrimSpace(headers[i])
+	if d.hasHeader {
+		rec, err := rr.Read()
+		if err != nil && !countMalformed(err, "slash-check", bucket, key) && !errors.Is(err, io.EOF) {
+			log.Println("Error scanning object", bucket, key, err)
+			count.Incr("slash-check-scan-error")
+
+			return
 		}
 
-		count.Incr("slash-check-header-found")
-		fmt.Println("Header has", len(headers), "columns in", bucket, key)
+		if rec != nil {
+			headers = slashHeaders(rec.fields, bucket, key)
+		}
 	}
 
-	lineNum := 0
-	rowsWithSlash := 0
+	t := slashTally{}
 	headerPrinted := false
+	sampler := newRowSampler(bucket, key)
 
-	for scanner.Scan() {
-		lineNum++
-
-		count.Incr("slash-check-row")
-		count.Incr("slash-check-row-" + baseName)
-
-		line := scanner.Text()
-		fields := strings.Split(line, ",")
-		rowHadSlash := false
-
-		for i, val := range fields {
-			if !strings.Contains(val, "\\") {
-				continue
-			}
+	for {
+		rec, err := rr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
 
-			rowHadSlash = true
-			colName := columnLabel(headers, i)
+		if err != nil && !countMalformed(err, "slash-check", bucket, key) {
+			log.Println("Error scanning object", bucket, key, err)
+			count.Incr("slash-check-scan-error")
 
-			count.Incr("slash-in-col-" + colName)
-			count.Incr("slash-in-col-" + colName + "-" + baseName)
+			return
+		}
 
-			// Flag the especially problematic pattern: a field that is just "\".
-			if val == "\\" {
-				count.Incr("slash-only-col-" + colName)
-				count.Incr("slash-only-col-" + colName + "-" + baseName)
-			}
+		t.lines++
 
-			// Field ending with \ — in a CSV this escapes the following delimiter.
-			if strings.HasSuffix(val, "\\") {
-				count.Incr("slash-trailing-col-" + colName)
-				count.Incr("slash-trailing-col-" + colName + "-" + baseName)
-			}
+		cols := checkSlashRow(rec, headers, baseName)
+		if len(cols) == 0 {
+			continue
 		}
 
-		if rowHadSlash {
-			rowsWithSlash++
+		t.rows++
 
-			count.Incr("slash-rows")
-			count.Incr("slash-rows-" + baseName)
+		sampler.add(cols, sampledRow{line: rec.line, offset: rec.offset, raw: rec.raw})
 
-			if !headerPrinted {
-				fmt.Println("=== OFFENDING ROWS in", bucket+"/"+key, "===")
-				fmt.Println("HEADER:", strings.Join(headers, ","))
+		if !theConfig["slashPrintRows"].BoolVal {
+			continue
+		}
 
-				headerPrinted = true
-			}
+		if !headerPrinted {
+			printSlashHeader(bucket, key, headers, d)
 
-			fmt.Printf("FILE=%s LINE=%d ROW=%s\n", baseName, lineNum, line)
+			headerPrinted = true
 		}
-	}
 
-	if err := scanner.Err(); err != nil {
-		log.Println("Error scanning object", bucket, key, err)
-		count.Incr("slash-check-scan-error")
-
-		return
+		fmt.Printf("FILE=%s LINE=%d ROW=%s\n", baseName, rec.line, rec.raw)
 	}
 
-	fmt.Println("Slash-scan:", lineNum, "lines,", rowsWithSlash, "rows with a stray \\ in", bucket, key)
-	count.IncrDelta("slash-check-lines", int64(lineNum))
+	sampler.write()
+	finishSlashCheck(bucket, key, t)
 }
 
 // columnLabel returns the header column name for the given index,
@@ -0,0 +1,304 @@
+// -*- tab-width: 2 -*-
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	kindFinding  = "finding"
+	kindMutation = "mutation"
+	kindError    = "error"
+	kindMode     = "mode"
+
+	summaryFileMode = 0o600
+)
+
+// findingRule maps a counter to a finding category and severity.  A
+// name ending in "-" matches as a prefix.
+type findingRule struct {
+	name     string
+	category string
+	severity string
+}
+
+// findingRules are the counters that are findings.  A condition counted
+// under two names is listed once: no default encryption is
+// posture-no-default-enc, not the bucket-enc-none it comes from.
+var findingRules = []findingRule{
+	{"encrypt-bad", "encryption", severityHigh},
+	{"unencrypted", "encryption", severityHigh},
+	{"encrypt-no-sse-fail", "encryption", severityHigh},
+	{"encrypt-sse-c-fail", "encryption", severityMedium},
+	{"encrypt-keymismatch-fail", "encryption", severityHigh},
+	{"encrypt-key-state-fail", "encryption", severityHigh},
+	{"encrypt-no-kms-key-id-fail", "encryption", severityMedium},
+	{"encrypt-key-unexpected-account", "encryption", severityHigh},
+	{"posture-no-default-enc", "posture", severityHigh},
+	{"posture-no-deny-unencrypted", "posture", severityMedium},
+	{"posture-key-cross-account", "posture", severityMedium},
+	{"posture-key-not-enabled", "posture", severityHigh},
+	{"posture-no-bucket-key", "posture", severityLow},
+	{"access-public-bucket", "access", severityHigh},
+	{"access-public-grant", "access", severityHigh},
+	{"access-other-account-grant", "access", severityMedium},
+	{"access-no-public-access-block", "access", severityMedium},
+	{"bucket-public-access-block-none", "access", severityMedium},
+	{"acct-public-access-block-none", "access", severityMedium},
+	{"access-acls-enabled", "access", severityLow},
+	{"policy-finding-", "policy", severityMedium},
+	{"bad-acl-found", "acl", severityMedium},
+	{"bad-3acl-found", "acl", severityMedium},
+	{"desired-acl-missing", "acl", severityMedium},
+	{"desired-acl-extra", "acl", severityMedium},
+	{"ownership-foreign-owner", "ownership", severityMedium},
+	{"ownership-bucket-incompatible", "ownership", severityMedium},
+	{"slash-rows", "data-quality", severityMedium},
+	{"schema-violation", "data-quality", severityMedium},
+	{"schema-header-drift", "data-quality", severityMedium},
+	{"jsonl-malformed-line", "data-quality", severityMedium},
+	{"null-check-select-verify-mismatch", "data-quality", severityLow},
+	{"dedupe-duplicate-object", "duplicates", severityLow},
+	{"dedupe-duplicate-rows-in-file", "duplicates", severityLow},
+}
+
+// findingRuleFor returns the rule for a counter name.
+func findingRuleFor(name string) (findingRule, bool) {
+	for _, r := range findingRules {
+		if name == r.name || (strings.HasSuffix(r.name, "-") && strings.HasPrefix(name, r.name)) {
+			return r, true
+		}
+	}
+
+	return findingRule{}, false
+}
+
+// summaryKind says which part of the run summary a counter goes in,
+// "" for none.  Mutations are the write calls to AWS.
+func summaryKind(name string) string {
+	if _, ok := findingRuleFor(name); ok {
+		return kindFinding
+	}
+
+	switch {
+	case strings.HasPrefix(name, "aws-put-"), strings.HasPrefix(name, "aws-copy"),
+		strings.HasPrefix(name, "aws-delete"), strings.HasPrefix(name, "aws-upload-"):
+		return kindMutation
+	case strings.Contains(name, "error"), strings.HasSuffix(name, "-failed"), strings.HasSuffix(name, "-fail"):
+		return kindError
+	case strings.HasPrefix(name, "handle-"), name == "total-object", name == "total-bucket":
+		return kindMode
+	}
+
+	return ""
+}
+
+// summaryCount is one counter, per bucket or ("") over all.
+type summaryCount struct {
+	Category string `json:"category,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Name     string `json:"name"`
+	Bucket   string `json:"bucket,omitempty"`
+	Count    int64  `json:"count"`
+}
+
+// runSummary is the end of run report.
+type runSummary struct {
+	Start           time.Time         `json:"start"`
+	End             time.Time         `json:"end"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Config          map[string]string `json:"config"`
+	Objects         int64             `json:"objects"`
+	Bytes           int64             `json:"bytes"`
+	Accounts        []*accountStatus  `json:"accounts"`
+	Buckets         []bucketStatus    `json:"buckets"`
+	Modes           []summaryCount    `json:"modes"`
+	Findings        []summaryCount    `json:"findings"`
+	Mutations       []summaryCount    `json:"mutations"`
+	Errors          []summaryCount    `json:"errors"`
+}
+
+// severityRank sorts high first.
+func severityRank(s string) int {
+	switch s {
+	case severityHigh:
+		return 0
+	case severityMedium:
+		return 1
+	}
+
+	return 2 //nolint:mnd
+}
+
+// buildRunSummary gathers the summary from the counter totals, which
+// syncMetricTotals set to the counters' final values, and the progress
+// tracker.
+func buildRunSummary() runSummary {
+	rs := status()
+	sum := runSummary{
+		Start:           theCtx.progressStart,
+		End:             time.Now(),
+		DurationSeconds: rs.ElapsedSeconds,
+		Config:          make(map[string]string),
+		Objects:         rs.Objects,
+		Bytes:           rs.Bytes,
+		Accounts:        rs.Accounts,
+		Buckets:         rs.Buckets,
+	}
+
+	for k, v := range theConfig {
+		sum.Config[k] = v.StrVal
+	}
+
+	theCtx.metricsRW.Lock()
+
+	for s, v := range theCtx.metrics {
+		if v == 0 {
+			continue
+		}
+
+		c := summaryCount{Name: s.name, Bucket: s.bucket, Count: v}
+
+		switch summaryKind(s.name) {
+		case kindFinding:
+			r, _ := findingRuleFor(s.name)
+			c.Category, c.Severity = r.category, r.severity
+			sum.Findings = append(sum.Findings, c)
+		case kindMutation:
+			sum.Mutations = append(sum.Mutations, c)
+		case kindError:
+			sum.Errors = append(sum.Errors, c)
+		case kindMode:
+			sum.Modes = append(sum.Modes, c)
+		}
+	}
+
+	theCtx.metricsRW.Unlock()
+
+	byName := func(l []summaryCount) {
+		sort.Slice(l, func(i, j int) bool {
+			if l[i].Name != l[j].Name {
+				return l[i].Name < l[j].Name
+			}
+
+			return l[i].Bucket < l[j].Bucket
+		})
+	}
+
+	byName(sum.Modes)
+	byName(sum.Mutations)
+	byName(sum.Errors)
+	byName(sum.Findings)
+	sort.SliceStable(sum.Findings, func(i, j int) bool {
+		a, b := sum.Findings[i], sum.Findings[j]
+		if a.Severity != b.Severity {
+			return severityRank(a.Severity) < severityRank(b.Severity)
+		}
+
+		return a.Category < b.Category
+	})
+
+	return sum
+}
+
+// bucketCell shows the over all row as "all".
+func bucketCell(b string) string {
+	if b == "" {
+		return "all"
+	}
+
+	return b
+}
+
+// markdownRunSummary renders the summary as Markdown tables.
+func markdownRunSummary(sum runSummary) string { //nolint:cyclop
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Run summary\n\n")
+	fmt.Fprintf(&b, "| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Start | %s |\n", sum.Start.Format(time.RFC3339))
+	fmt.Fprintf(&b, "| End | %s |\n", sum.End.Format(time.RFC3339))
+	fmt.Fprintf(&b, "| Duration | %s |\n", time.Duration(sum.DurationSeconds*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(&b, "| Accounts | %d |\n", len(sum.Accounts))
+	fmt.Fprintf(&b, "| Buckets | %d |\n", len(sum.Buckets))
+	fmt.Fprintf(&b, "| Objects | %d |\n", sum.Objects)
+	fmt.Fprintf(&b, "| Bytes | %d |\n", sum.Bytes)
+
+	fmt.Fprintf(&b, "\n## Accounts\n\n| Account | Buckets done | Running | Queued | Objects | Bytes |\n|---|---|---|---|---|---|\n")
+
+	for _, a := range sum.Accounts {
+		fmt.Fprintf(&b, "| %s | %d | %d | %d | %d | %d |\n", a.Account, a.Done, a.Running, a.Queued, a.Objects, a.Bytes)
+	}
+
+	fmt.Fprintf(&b, "\n## Buckets\n\n| Bucket | Account | State | Objects | Bytes |\n|---|---|---|---|---|\n")
+
+	for _, bs := range sum.Buckets {
+		fmt.Fprintf(&b, "| %s | %s | %s | %d | %d |\n", bs.Bucket, bs.Account, bs.State, bs.Objects, bs.Bytes)
+	}
+
+	fmt.Fprintf(&b, "\n## Findings\n\n| Severity | Category | Counter | Bucket | Count |\n|---|---|---|---|---|\n")
+
+	for _, f := range sum.Findings {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %d |\n", f.Severity, f.Category, f.Name, bucketCell(f.Bucket), f.Count)
+	}
+
+	for _, t := range []struct {
+		title string
+		rows  []summaryCount
+	}{{"Objects per mode", sum.Modes}, {"Mutations", sum.Mutations}, {"Errors", sum.Errors}} {
+		fmt.Fprintf(&b, "\n## %s\n\n| Counter | Bucket | Count |\n|---|---|---|\n", t.title)
+
+		for _, c := range t.rows {
+			fmt.Fprintf(&b, "| %s | %s | %d |\n", c.Name, bucketCell(c.Bucket), c.Count)
+		}
+	}
+
+	keys := make([]string, 0, len(sum.Config))
+	for k := range sum.Config {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	fmt.Fprintf(&b, "\n## Config\n\n| Key | Value |\n|---|---|\n")
+
+	for _, k := range keys {
+		fmt.Fprintf(&b, "| %s | %s |\n", k, strings.ReplaceAll(sum.Config[k], "|", `\|`))
+	}
+
+	return b.String()
+}
+
+// writeRunSummary writes the summary as JSON to summaryJson and as
+// Markdown to summaryMarkdown; an empty name skips that one.
+func writeRunSummary() {
+	sum := buildRunSummary()
+
+	if fn := theConfig["summaryJson"].StrVal; fn != "" {
+		data, err := json.MarshalIndent(sum, "", "  ")
+		if err == nil {
+			err = os.WriteFile(fn, data, summaryFileMode)
+		}
+
+		if err != nil {
+			log.Println("Error writing run summary", fn, err)
+		} else {
+			log.Println("Wrote run summary", fn)
+		}
+	}
+
+	if fn := theConfig["summaryMarkdown"].StrVal; fn != "" {
+		if err := os.WriteFile(fn, []byte(markdownRunSummary(sum)), summaryFileMode); err != nil {
+			log.Println("Error writing run summary", fn, err)
+		} else {
+			log.Println("Wrote run summary", fn)
+		}
+	}
+}